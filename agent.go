@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// agentForwarder makes the SSH agent of the client available to the commands
+// of a session via a Unix socket (SSH_AUTH_SOCK), whose connections are
+// forwarded to the client in auth-agent@openssh.com channels.
+type agentForwarder struct {
+	dir  string
+	path string
+	ln   net.Listener
+}
+
+// startAgentForwarding creates the agent socket for session s in a new
+// temporary directory, accessible only to the user running its commands.
+func (s *session) startAgentForwarding() (*agentForwarder, error) {
+	dir, err := os.MkdirTemp("", "ssh-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "agent")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if cred := s.opts.credential; cred != nil {
+		for _, fn := range []string{dir, path} {
+			if err := os.Chown(fn, int(cred.Uid), int(cred.Gid)); err != nil {
+				ln.Close()
+				os.RemoveAll(dir)
+				return nil, err
+			}
+		}
+	}
+	a := &agentForwarder{dir: dir, path: path, ln: ln}
+	go a.serve(s.sconn)
+	return a, nil
+}
+
+func (a *agentForwarder) serve(sconn *ssh.ServerConn) {
+	for {
+		conn, err := a.ln.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		go func() {
+			defer conn.Close()
+			ch, reqs, err := sconn.OpenChannel("auth-agent@openssh.com", nil)
+			if err != nil {
+				log.Printf("auth-agent: %v", err)
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			defer ch.Close()
+			go func() {
+				defer ch.CloseWrite()
+				io.Copy(ch, conn)
+			}()
+			io.Copy(conn, ch)
+		}()
+	}
+}
+
+// close removes the agent socket. Connections which are already
+// established remain usable.
+func (a *agentForwarder) close() {
+	a.ln.Close()
+	os.RemoveAll(a.dir)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// auditLog records logins, commands, file transfers and port forwardings as
+// JSON lines. Until initAuditLog is called, it only writes to stderr.
+var auditLog = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+// rotatedAuditLogs is the number of rotated audit log files (.1, .2, …) to
+// keep in addition to the current one.
+const rotatedAuditLogs = 3
+
+// initAuditLog makes auditLog write to both stderr and the file at path,
+// which is rotated when it would exceed maxSize bytes.
+func initAuditLog(path string, maxSize int64) error {
+	w := &rotatingWriter{path: path, maxSize: maxSize}
+	if err := w.open(); err != nil {
+		return err
+	}
+	auditLog = slog.New(slog.NewJSONHandler(io.MultiWriter(os.Stderr, w), nil))
+	return nil
+}
+
+// rotatingWriter appends to the file at path. Before a write would make the
+// file larger than maxSize, the file is renamed to path.1 (path.1 is renamed
+// to path.2 and so on) and a new file is started.
+type rotatingWriter struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, st.Size()
+	return nil
+}
+
+func (w *rotatingWriter) rotate() error {
+	w.f.Close()
+	for i := rotatedAuditLogs - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	err := os.Rename(w.path, w.path+".1")
+	if oerr := w.open(); oerr != nil {
+		w.f = nil
+		return oerr
+	}
+	return err
+}
+
+func (w *rotatingWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, fmt.Errorf("%s: not open", w.path)
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			log.Printf("rotating %s: %v", w.path, err)
+			if w.f == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err = w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
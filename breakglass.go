@@ -16,8 +16,10 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gokrazy/gokapi"
 	"github.com/gokrazy/gokapi/ondeviceapi"
@@ -29,7 +31,91 @@ import (
 var (
 	authorizedKeysPath = flag.String("authorized_keys",
 		"/perm/breakglass.authorized_keys",
-		"path to an OpenSSH authorized_keys file; if the value is 'ec2', fetch the SSH key(s) from the AWS IMDSv2 metadata")
+		"comma-separated list of key sources: paths to OpenSSH authorized_keys files or directories of *.pub files, http(s):// URLs (e.g. https://github.com/<user>.keys), 'ec2' (AWS IMDSv2 metadata), 'gce' (Google Compute Engine metadata) or 'openstack' (OpenStack metadata service, or openstack:///<path> for a mounted config drive); append #refresh=<duration> to periodically reload a source")
+
+	authorizedKeysReloadInterval = flag.Duration("authorized_keys_reload_interval",
+		5*time.Second,
+		"how often to re-read -authorized_keys files and -revoked_keys for changes (0 disables checking; all keys are always reloaded on SIGHUP)")
+
+	trustedUserCAKeysPath = flag.String("trusted_user_ca_keys",
+		"",
+		"path to a file of CA public keys (in authorized_keys format); if non-empty, OpenSSH user certificates signed by these keys are accepted for users listed as certificate principals")
+
+	revokedKeysPath = flag.String("revoked_keys",
+		"",
+		"path to a file of revoked public keys (one per line) or a binary OpenSSH KRL (see ssh-keygen -k); listed keys and certificates are rejected")
+
+	usersPath = flag.String("users",
+		"",
+		"path to a file mapping SSH user names or key fingerprints to <uid>:<gid>[:<groups>] (one mapping per line); commands of mapped users run unprivileged, all others run as root")
+
+	auditLogPath = flag.String("audit_log",
+		"/perm/breakglass.audit.log",
+		"path to a file to which an audit log of logins, commands, file transfers and port forwardings is appended as JSON lines (in addition to stderr); empty disables the file")
+
+	auditLogMaxSize = flag.Int64("audit_log_max_size",
+		10<<20,
+		"size in bytes after which the -audit_log file is rotated")
+
+	recordDir = flag.String("record_dir",
+		"",
+		"if non-empty, a directory in which interactive (PTY) sessions are recorded in asciicast v2 format, one file per session")
+
+	recordMaxSize = flag.Int64("record_max_size",
+		50<<20,
+		"size in bytes after which the recording of a session is stopped")
+
+	idleTimeout = flag.Duration("idle_timeout",
+		0,
+		"if non-zero, exit once there were no connections for this long (e.g. 30m)")
+
+	maxLifetime = flag.Duration("max_lifetime",
+		0,
+		"if non-zero, exit after running for this long (e.g. 8h), regardless of active connections")
+
+	sessionIdleTimeout = flag.Duration("session_idle_timeout",
+		0,
+		"if non-zero, close sessions without any input or output for this long (e.g. 1h)")
+
+	sessionMaxDuration = flag.Duration("session_max_duration",
+		0,
+		"if non-zero, close sessions after they lasted for this long (e.g. 12h)")
+
+	maxConnections = flag.Int("max_connections",
+		64,
+		"maximum number of concurrent connections (0 disables the limit)")
+
+	maxHandshakesPerIP = flag.Int("max_handshakes_per_ip",
+		4,
+		"maximum number of concurrent unauthenticated connections per remote IP address (0 disables the limit)")
+
+	maxAuthFailures = flag.Int("max_auth_failures",
+		5,
+		"number of consecutive failed logins after which a remote IP address is temporarily banned (0 disables banning)")
+
+	banDuration = flag.Duration("ban_duration",
+		time.Minute,
+		"duration of the first ban of a remote IP address; each subsequent ban lasts twice as long (up to 24h)")
+
+	handshakeTimeout = flag.Duration("handshake_timeout",
+		30*time.Second,
+		"time after which connections which did not complete the SSH handshake (including authentication) are closed")
+
+	acceptEnvPatterns = flag.String("accept_env",
+		"LANG,LC_*",
+		"comma-separated list of patterns (see path.Match) of environment variables which clients may set")
+
+	envFile = flag.String("env_file",
+		"/perm/breakglass.env",
+		"path to a file of environment variables (NAME=value, one per line) which are set for all commands, overriding variables set by the client; read on startup, a missing file is ignored")
+
+	strictExec = flag.Bool("strict_exec",
+		false,
+		"run the commands of exec requests directly, split into arguments like a shell would, but without interpreting them with sh -c (shell requests still start a shell); can be enabled per key with the strict-exec option")
+
+	persistentSessionTimeout = flag.Duration("persistent_session_timeout",
+		0,
+		"if non-zero, interactive (PTY) sessions keep running for this long after the client disconnected, so that they can be reattached using breakglass -attach=<id> <hostname>")
 
 	hostKeyPath = flag.String("host_key",
 		"/perm/breakglass.host_key",
@@ -45,34 +131,36 @@ var (
 
 	forwarding = flag.String("forward",
 		"",
-		"allow port forwarding. Use `loopback` for loopback interfaces and `private-network` for private networks")
-)
+		"allow port forwarding according to a comma-separated list of [!]host[:port] rules, the first matching rule decides (except that denied addresses take precedence over hostname patterns). host is an IP address, a CIDR network, a hostname pattern, * or `loopback` (loopback interfaces) or `private-network` (private networks); port is a port, a range like 6000-6100 or * (the default). Example: 127.0.0.1:6060,127.0.0.1:9090")
 
-func loadAuthorizedKeys(path string) (map[string]bool, error) {
-	var b []byte
-	var err error
-	switch path {
-	case "ec2":
-		b, err = loadAWSEC2SSHKeys()
-	default:
-		b, err = ioutil.ReadFile(path)
-	}
-	if err != nil {
-		return nil, err
-	}
+	forwardUnixSockets = flag.String("forward_unix_sockets",
+		"",
+		"comma-separated list of unix socket path patterns (e.g. /run/*.sock, see filepath.Match) which may be forwarded (ssh -L/-R with socket paths); empty disables unix socket forwarding")
+)
 
-	result := make(map[string]bool)
+// parseAuthorizedKeys parses the contents of an authorized_keys file and
+// returns the keys, mapped to the restrictions from their options field. name
+// is used in log messages.
+func parseAuthorizedKeys(name string, b []byte) (map[string]*keyOptions, error) {
+	result := make(map[string]*keyOptions)
 
 	s := bufio.NewScanner(bytes.NewReader(b))
 	for lineNum := 1; s.Scan(); lineNum++ {
 		if tr := strings.TrimSpace(s.Text()); tr == "" || strings.HasPrefix(tr, "#") {
 			continue
 		}
-		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(s.Bytes())
+		pubKey, _, options, _, err := ssh.ParseAuthorizedKey(s.Bytes())
 		if err != nil {
 			return nil, err
 		}
-		result[string(pubKey.Marshal())] = true
+		opts, err := parseKeyOptions(options)
+		if err != nil {
+			// Skip the key instead of failing to start, but never accept
+			// it with fewer restrictions than the file specifies.
+			log.Printf("%s:%d: ignoring key: %v", name, lineNum, err)
+			continue
+		}
+		result[string(pubKey.Marshal())] = opts
 	}
 	if err := s.Err(); err != nil {
 		return nil, err
@@ -169,31 +257,114 @@ func initMOTD() error {
 }
 
 func main() {
+	switch filepath.Base(os.Args[0]) {
+	case "sh":
+		// breakglass runs itself as sh when there is no other shell, see
+		// findShell.
+		os.Exit(goShell(os.Args[1:]))
+	case "gok":
+		os.Exit(gokMain(os.Args[1:]))
+	}
+
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	gokrazy.DontStartOnBoot()
 
-	authorizedKeys, err := loadAuthorizedKeys(*authorizedKeysPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Printf("see https://github.com/gokrazy/breakglass#installation")
+	if *auditLogPath != "" {
+		if err := initAuditLog(*auditLogPath, *auditLogMaxSize); err != nil {
+			log.Printf("audit log: %v (logging to stderr only)", err)
 		}
+	}
+
+	sources, err := parseKeySources(*authorizedKeysPath, *authorizedKeysReloadInterval)
+	if err != nil {
 		log.Fatal(err)
 	}
+	keys := newKeyStore(sources, *revokedKeysPath, *authorizedKeysReloadInterval)
+	if err := keys.load(); err != nil {
+		if !keys.revocationsLoaded() {
+			log.Fatal(err)
+		}
+		// Certificates are sufficient to log in, so not having any
+		// authorized keys is not an error when a CA is configured.
+		if *trustedUserCAKeysPath == "" {
+			if os.IsNotExist(err) {
+				log.Printf("see https://github.com/gokrazy/breakglass#installation")
+			}
+			log.Fatal(err)
+		}
+	}
+	go keys.watch()
 
 	if err := initMOTD(); err != nil {
 		log.Print(err)
 	}
 
+	authorizedKeyCallback := func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+		opts, ok := keys.lookup(pubKey)
+		if !ok {
+			return nil, fmt.Errorf("public key not found in %s", *authorizedKeysPath)
+		}
+		if err := opts.check(conn); err != nil {
+			log.Printf("user %q from remote addr %s: %v", conn.User(), conn.RemoteAddr(), err)
+			return nil, err
+		}
+		log.Printf("user %q successfully authorized from remote addr %s", conn.User(), conn.RemoteAddr())
+		return opts.permissions(), nil
+	}
+
 	config := &ssh.ServerConfig{
-		PublicKeyCallback: func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			if authorizedKeys[string(pubKey.Marshal())] {
-				log.Printf("user %q successfully authorized from remote addr %s", conn.User(), conn.RemoteAddr())
-				return nil, nil
+		PublicKeyCallback: authorizedKeyCallback,
+	}
+
+	if *trustedUserCAKeysPath != "" {
+		caKeys, err := loadTrustedUserCAKeys(*trustedUserCAKeysPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		checker := newCertChecker(caKeys, authorizedKeyCallback)
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			perms, err := authenticateCert(checker, conn, pubKey)
+			if err != nil {
+				return nil, err
 			}
-			return nil, fmt.Errorf("public key not found in %s", *authorizedKeysPath)
-		},
+			if cert, ok := pubKey.(*ssh.Certificate); ok {
+				log.Printf("user %q successfully authorized with certificate %q (serial %d) from remote addr %s", conn.User(), cert.KeyId, cert.Serial, conn.RemoteAddr())
+			}
+			return perms, nil
+		}
+	}
+
+	var users userMap
+	if *usersPath != "" {
+		users, err = loadUserMap(*usersPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	authenticate := config.PublicKeyCallback
+	config.PublicKeyCallback = func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+		if keys.isRevoked(pubKey) {
+			log.Printf("user %q from remote addr %s: rejecting revoked key %s", conn.User(), conn.RemoteAddr(), ssh.FingerprintSHA256(pubKey))
+			return nil, fmt.Errorf("key is revoked")
+		}
+		perms, err := authenticate(conn, pubKey)
+		if err != nil {
+			return nil, err
+		}
+		if perms.Extensions == nil {
+			perms.Extensions = make(map[string]string)
+		}
+		perms.Extensions["fingerprint"] = ssh.FingerprintSHA256(pubKey)
+		if cred := users.lookup(conn.User(), pubKey); cred != nil {
+			opts := *connOptions(perms)
+			opts.credential = cred
+			perms.ExtraData[keyOptionsKey{}] = &opts
+			log.Printf("user %q runs commands as uid %d, gid %d", conn.User(), cred.Uid, cred.Gid)
+		}
+		return perms, nil
 	}
 
 	signer, err := loadHostKey(*hostKeyPath)
@@ -223,7 +394,11 @@ func main() {
 	// without NOEXEC and that we have plenty of space for payload.
 	// It will be cleaned up on process exit because each gokrazy
 	// process uses a non-shared mount namespace.
-	if err := syscall.Mount("tmpfs", unpackDir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RELATIME, "size=500M"); err != nil {
+	//
+	// The directory is first in the $PATH of all sessions, so it must
+	// only be writable by root: otherwise, unprivileged users (see
+	// -users) could place commands there which root then runs.
+	if err := syscall.Mount("tmpfs", unpackDir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RELATIME, "size=500M,mode=0755"); err != nil {
 		log.Fatalf("tmpfs on %s: %v", unpackDir, err)
 	}
 
@@ -235,6 +410,29 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Make the gok command (see gok.go) available in all sessions. Like
+	// all commands in unpackDir, it cannot be replaced by unprivileged
+	// users.
+	if self, err := os.Executable(); err == nil {
+		if err := os.Symlink(self, filepath.Join(unpackDir, "gok")); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if *envFile != "" {
+		serverEnv, err = loadEnvFile(*envFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	forwardingPolicy, err = parseForwardPolicy(*forwarding)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	limits := newLimiter(*maxConnections, *maxHandshakesPerIP, *maxAuthFailures, *banDuration)
+	go limits.expireLoop()
 	accept := func(listener net.Listener) {
 		for {
 			conn, err := listener.Accept()
@@ -243,18 +441,40 @@ func main() {
 				continue
 			}
 
+			ip := remoteIP(conn.RemoteAddr())
+			if err := limits.acquire(ip); err != nil {
+				// Not logged to avoid flooding the logs while banned.
+				conn.Close()
+				continue
+			}
+
 			go func(conn net.Conn) {
-				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				defer conn.Close()
+				defer limits.release()
+				if *handshakeTimeout > 0 {
+					conn.SetDeadline(time.Now().Add(*handshakeTimeout))
+				}
+				sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if ban := limits.handshakeDone(ip, err); ban > 0 {
+					log.Printf("banning %s for %v after %d failed logins", ip, ban, *maxAuthFailures)
+					auditLog.Warn("ban", "remote_addr", ip, "duration", ban.String())
+				}
 				if err != nil {
 					log.Printf("handshake: %v", err)
+					auditLog.Warn("handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err.Error())
 					return
 				}
+				conn.SetDeadline(time.Time{})
+				c := newConnection(sconn)
+				c.audit.Info("login")
+				defer c.audit.Info("logout")
+				usage.begin()
+				defer usage.end()
 
-				// discard all out of band requests
-				go ssh.DiscardRequests(reqs)
+				go c.handleGlobalRequests(reqs)
 
 				for newChannel := range chans {
-					handleChannel(newChannel)
+					handleChannel(c, newChannel)
 				}
 			}(conn)
 		}
@@ -277,5 +497,15 @@ func main() {
 
 	fmt.Printf("host key fingerprint: %s\n", ssh.FingerprintSHA256(signer.PublicKey()))
 
-	select {}
+	reason := waitForShutdown(usage, *idleTimeout, *maxLifetime)
+	log.Printf("%s, exiting", reason)
+	auditLog.Info("shutdown", "reason", reason)
+	// Do not leave the commands of (detached) PTY sessions and of exec
+	// requests running.
+	hangupPTYSessions()
+	killExecCommands()
+	os.RemoveAll(unpackDir)
+	// Exit status 125 tells the gokrazy supervisor to not restart
+	// breakglass, i.e. it stays stopped until started again.
+	os.Exit(125)
 }
@@ -3,82 +3,158 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
-// getEC2MetadataToken returns an IMDSv2 token from the AWS EC2 metadata
+// ec2MetadataBaseURL is the IPv4 endpoint of the instance metadata service.
+const ec2MetadataBaseURL = "http://169.254.169.254/latest/"
+
+// newEC2KeySource returns a key source for the AWS EC2 metadata service. The
+// endpoint can be overridden with a host, e.g. ec2://[fd00:ec2::254] for the
+// IPv6 endpoint.
+func newEC2KeySource(u *url.URL) (keySource, error) {
+	md := newEC2Metadata(ec2MetadataBaseURL)
+	if u.Host != "" {
+		md.baseURL = "http://" + u.Host + "/latest/"
+	}
+	return keySourceFunc(md.loadSSHKeys), nil
+}
+
+// ec2Metadata is a client for the AWS EC2 instance metadata service (IMDSv2).
+type ec2Metadata struct {
+	// baseURL is the URL under which api/token and meta-data/ are located.
+	baseURL string
+	client  *http.Client
+
+	// attempts is the maximum number of attempts to load the keys, with
+	// an exponentially increasing delay (starting at backoff) between
+	// attempts. The metadata service might not be reachable yet when
+	// breakglass is started early during boot.
+	attempts int
+	backoff  time.Duration
+}
+
+func newEC2Metadata(baseURL string) *ec2Metadata {
+	return &ec2Metadata{
+		baseURL:  baseURL,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		attempts: 6,
+		backoff:  500 * time.Millisecond,
+	}
+}
+
+// httpStatusError is returned for unexpected HTTP status codes.
+type httpStatusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected HTTP status %v", e.url, e.status)
+}
+
+// retryable reports whether err might be resolved by trying again, i.e.
+// whether it is not a client error (such as 404 Not Found).
+func retryable(err error) bool {
+	var se *httpStatusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusUnauthorized
+	}
+	return true
+}
+
+func (m *ec2Metadata) do(req *http.Request) ([]byte, error) {
+	res, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{url: req.URL.String(), status: res.Status, code: res.StatusCode}
+	}
+	return io.ReadAll(res.Body)
+}
+
+// getToken returns an IMDSv2 token from the AWS EC2 metadata
 // server. This is needed for subsequent metadata requests, at least when
 // the VM was created in IMDSv2-required mode, as is common.
 //
 // See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ec2-instance-metadata.html
-func getEC2MetadataToken() (string, error) {
-	req, _ := http.NewRequest("PUT", "http://169.254.169.254/latest/api/token", nil)
+func (m *ec2Metadata) getToken() (string, error) {
+	req, _ := http.NewRequest("PUT", m.baseURL+"api/token", nil)
 	req.Header.Add("X-aws-ec2-metadata-token-ttl-seconds", "300")
-	res, err := http.DefaultClient.Do(req)
+	all, err := m.do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to get metadata token: %w", err)
 	}
-	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		return "", fmt.Errorf("failed to get metadata token: %v", res.Status)
-	}
-	all, err := io.ReadAll(res.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read metadata token: %w", err)
-	}
 	return strings.TrimSpace(string(all)), nil
 }
 
-// loadAWSEC2SSHKeys returns 1 or more SSH public keys from the AWS
-// EC2 metadata server and returns them concatenanted, one per line,
-// as if they were all together in an ~/.ssh/authorized_keys file.
+func (m *ec2Metadata) get(token, path string) ([]byte, error) {
+	req, _ := http.NewRequest("GET", m.baseURL+path, nil)
+	req.Header.Add("X-aws-ec2-metadata-token", token)
+	return m.do(req)
+}
+
+// loadSSHKeysOnce returns all SSH public keys listed under
+// meta-data/public-keys/, one per line, as if they were all together in an
+// ~/.ssh/authorized_keys file.
 //
 // See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instancedata-data-retrieval.html#instance-metadata-ex-5
-func loadAWSEC2SSHKeys() ([]byte, error) {
-	token, err := getEC2MetadataToken()
+func (m *ec2Metadata) loadSSHKeysOnce() ([]byte, error) {
+	token, err := m.getToken()
 	if err != nil {
 		return nil, err
 	}
-	var authorizedKeys bytes.Buffer
-	getKeyIndex := func(idx int) error {
-		req, _ := http.NewRequest("GET", fmt.Sprintf("http://169.254.169.254/latest/meta-data/public-keys/%d/openssh-key", idx), nil)
-		req.Header.Add("X-aws-ec2-metadata-token", token)
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
-		}
-		defer res.Body.Close()
-		if res.StatusCode != 200 {
-			return errors.New(res.Status)
-		}
-		all, err := io.ReadAll(res.Body)
-		if err != nil {
-			return err
-		}
-		// Write out a ~/.ssh/authorized_keys -looking file,
-		// with each key on its own line.
-		fmt.Fprintf(&authorizedKeys, "%s\n", bytes.TrimSpace(all))
-		return nil
+	// The listing contains one line per key pair, e.g. 0=my-key-pair
+	index, err := m.get(token, "meta-data/public-keys/")
+	if err != nil {
+		return nil, err
 	}
-	for i := 0; ; i++ {
-		err := getKeyIndex(i)
-		if err == nil {
+	var authorizedKeys bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(index))
+	for s.Scan() {
+		idx, _, _ := strings.Cut(strings.TrimSpace(s.Text()), "=")
+		if idx == "" {
 			continue
 		}
-		if i == 0 {
-			// We expect at least one SSH key (index 0) if the
-			// use requested this mode, so return an error if the
-			// first one fails.
+		key, err := m.get(token, "meta-data/public-keys/"+idx+"/openssh-key")
+		if err != nil {
 			return nil, err
 		}
-		// But on subsequent errors, just assume we've hit the end.
-		// This is a little lazy.
-		break
+		fmt.Fprintf(&authorizedKeys, "%s\n", bytes.TrimSpace(key))
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if authorizedKeys.Len() == 0 {
+		// We expect at least one SSH key if the user requested this
+		// mode.
+		return nil, fmt.Errorf("no SSH keys found in EC2 instance metadata")
 	}
 	return authorizedKeys.Bytes(), nil
 }
+
+// loadSSHKeys calls loadSSHKeysOnce, retrying on transient errors.
+func (m *ec2Metadata) loadSSHKeys() ([]byte, error) {
+	backoff := m.backoff
+	for attempt := 1; ; attempt++ {
+		b, err := m.loadSSHKeysOnce()
+		if err == nil || !retryable(err) || attempt >= m.attempts {
+			return b, err
+		}
+		log.Printf("loading EC2 SSH keys (attempt %d of %d): %v, retrying in %v", attempt, m.attempts, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
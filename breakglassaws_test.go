@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testIMDSToken = "test-token"
+
+// fakeIMDS is a stand-in for the EC2 instance metadata service (IMDSv2).
+type fakeIMDS struct {
+	keys []string
+
+	failures   atomic.Int32 // number of token requests to fail with 503
+	tokenCalls atomic.Int32
+	indexCode  int // if non-zero, the status of the key listing
+}
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/latest/api/token" {
+		f.tokenCalls.Add(1)
+		if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			http.Error(w, "bad token request", http.StatusBadRequest)
+			return
+		}
+		if f.failures.Add(-1) >= 0 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, testIMDSToken)
+		return
+	}
+	if r.Header.Get("X-aws-ec2-metadata-token") != testIMDSToken {
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return
+	}
+	const prefix = "/latest/meta-data/public-keys/"
+	if r.URL.Path == prefix {
+		if f.indexCode != 0 {
+			http.Error(w, "index", f.indexCode)
+			return
+		}
+		for i := range f.keys {
+			fmt.Fprintf(w, "%d=key-pair-%d\n", i, i)
+		}
+		return
+	}
+	var idx int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, prefix), "%d/openssh-key", &idx); err != nil || idx >= len(f.keys) {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintln(w, f.keys[idx])
+}
+
+func newTestEC2Metadata(t *testing.T, f *fakeIMDS) *ec2Metadata {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	md := newEC2Metadata(srv.URL + "/latest/")
+	md.attempts = 3
+	md.backoff = time.Millisecond
+	return md
+}
+
+func TestEC2LoadSSHKeys(t *testing.T) {
+	f := &fakeIMDS{keys: []string{"ssh-ed25519 AAAA first", "ssh-ed25519 BBBB second"}}
+	b, err := newTestEC2Metadata(t, f).loadSSHKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "ssh-ed25519 AAAA first\nssh-ed25519 BBBB second\n"; got != want {
+		t.Errorf("loadSSHKeys() = %q, want %q", got, want)
+	}
+}
+
+func TestEC2LoadSSHKeysRetry(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		failures  int32
+		indexCode int
+		wantErr   bool
+		wantCalls int32
+	}{
+		{name: "transient failure", failures: 2, wantCalls: 3},
+		{name: "persistent failure", failures: 5, wantErr: true, wantCalls: 3},
+		{name: "not found", indexCode: http.StatusNotFound, wantErr: true, wantCalls: 1},
+		{name: "server error", indexCode: http.StatusInternalServerError, wantErr: true, wantCalls: 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeIMDS{
+				keys:      []string{"ssh-ed25519 AAAA first"},
+				indexCode: tt.indexCode,
+			}
+			f.failures.Store(tt.failures)
+			_, err := newTestEC2Metadata(t, f).loadSSHKeys()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("loadSSHKeys() = %v, want error: %v", err, tt.wantErr)
+			}
+			if got := f.tokenCalls.Load(); got != tt.wantCalls {
+				t.Errorf("loadSSHKeys() made %d attempts, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestEC2LoadSSHKeysEmpty(t *testing.T) {
+	if _, err := newTestEC2Metadata(t, &fakeIMDS{}).loadSSHKeys(); err == nil {
+		t.Errorf("loadSSHKeys() without keys unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,124 @@
+// Code for interacting with Google Compute Engine.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const gceMetadataBaseURL = "http://metadata.google.internal/computeMetadata/v1/"
+
+func newGCEKeySource(u *url.URL) (keySource, error) {
+	return keySourceFunc(loadGCESSHKeys), nil
+}
+
+// getGCEMetadata returns the specified metadata value, or an empty string if
+// the value is not set.
+func getGCEMetadata(path string) (string, error) {
+	req, _ := http.NewRequest("GET", gceMetadataBaseURL+path, nil)
+	req.Header.Add("Metadata-Flavor", "Google")
+	res, err := keySourceClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %v", path, res.Status)
+	}
+	all, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(all), nil
+}
+
+// gceKeyLine converts a line of the ssh-keys metadata to authorized_keys
+// format by removing the “username:” prefix. Keys with an expiration time,
+// as added by gcloud, e.g.
+//
+//	user:ssh-ed25519 AAAA… google-ssh {"userName":"user@example.com","expireOn":"2025-06-14T16:59:03+0000"}
+//
+// get an expiry-time option, or are omitted (an empty line is returned) if
+// they expired before now.
+func gceKeyLine(line string, now time.Time) (string, error) {
+	if _, key, ok := strings.Cut(line, ":"); ok {
+		line = key
+	}
+	_, comment, ok := strings.Cut(line, " google-ssh ")
+	if !ok {
+		return line, nil
+	}
+	var info struct {
+		ExpireOn string `json:"expireOn"`
+	}
+	if err := json.Unmarshal([]byte(comment), &info); err != nil {
+		return "", fmt.Errorf("google-ssh comment: %v", err)
+	}
+	if info.ExpireOn == "" {
+		return line, nil
+	}
+	expireOn, err := time.Parse("2006-01-02T15:04:05-0700", info.ExpireOn)
+	if err != nil {
+		if expireOn, err = time.Parse(time.RFC3339, info.ExpireOn); err != nil {
+			return "", fmt.Errorf("invalid expireOn: %v", err)
+		}
+	}
+	if !now.Before(expireOn) {
+		return "", nil
+	}
+	return fmt.Sprintf(`expiry-time="%s" %s`, expireOn.UTC().Format("20060102150405Z"), line), nil
+}
+
+// loadGCESSHKeys returns the SSH public keys from the instance and (unless
+// blocked) project ssh-keys metadata, converted using gceKeyLine.
+//
+// See https://cloud.google.com/compute/docs/connect/add-ssh-keys
+func loadGCESSHKeys() ([]byte, error) {
+	paths := []string{"instance/attributes/ssh-keys"}
+	block, err := getGCEMetadata("instance/attributes/block-project-ssh-keys")
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(block) != "true" {
+		paths = append(paths, "project/attributes/ssh-keys")
+	}
+	var authorizedKeys bytes.Buffer
+	for _, path := range paths {
+		keys, err := getGCEMetadata(path)
+		if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(strings.NewReader(keys))
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" {
+				continue
+			}
+			line, err := gceKeyLine(line, time.Now())
+			if err != nil {
+				log.Printf("gce: %s: ignoring key: %v", path, err)
+				continue
+			}
+			if line == "" {
+				continue // expired
+			}
+			fmt.Fprintf(&authorizedKeys, "%s\n", line)
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return authorizedKeys.Bytes(), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGCEKeyLine(t *testing.T) {
+	pub, _ := newTestKey(t)
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		line   string
+		want   string // empty if the key is omitted
+		expiry time.Time
+	}{
+		{
+			line: "alice:" + key + " alice",
+			want: key + " alice",
+		},
+		{
+			line: key,
+			want: key,
+		},
+		{
+			line:   "alice:" + key + ` google-ssh {"userName":"alice@example.com","expireOn":"2025-06-14T16:59:03+0000"}`,
+			want:   `expiry-time="20250614165903Z" ` + key + ` google-ssh {"userName":"alice@example.com","expireOn":"2025-06-14T16:59:03+0000"}`,
+			expiry: time.Date(2025, 6, 14, 16, 59, 3, 0, time.UTC),
+		},
+		{
+			line:   "alice:" + key + ` google-ssh {"userName":"alice@example.com","expireOn":"2025-06-14T18:59:03+02:00"}`,
+			want:   `expiry-time="20250614165903Z" ` + key + ` google-ssh {"userName":"alice@example.com","expireOn":"2025-06-14T18:59:03+02:00"}`,
+			expiry: time.Date(2025, 6, 14, 16, 59, 3, 0, time.UTC),
+		},
+		{
+			line: "alice:" + key + ` google-ssh {"userName":"alice@example.com","expireOn":"2025-05-31T23:59:59+0000"}`,
+			want: "",
+		},
+		{
+			line: "alice:" + key + ` google-ssh {"userName":"alice@example.com"}`,
+			want: key + ` google-ssh {"userName":"alice@example.com"}`,
+		},
+	} {
+		got, err := gceKeyLine(tt.line, now)
+		if err != nil {
+			t.Errorf("gceKeyLine(%q): %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("gceKeyLine(%q) = %q, want %q", tt.line, got, tt.want)
+			continue
+		}
+		if got == "" {
+			continue
+		}
+		keys, err := parseAuthorizedKeys("gce", []byte(got))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, ok := keys[string(pub.Marshal())]
+		if !ok {
+			t.Errorf("gceKeyLine(%q): key not parsed from %q", tt.line, got)
+			continue
+		}
+		if !opts.expiryTime.Equal(tt.expiry) {
+			t.Errorf("gceKeyLine(%q): expiry time = %v, want %v", tt.line, opts.expiryTime, tt.expiry)
+		}
+	}
+}
+
+func TestGCEKeyLineErrors(t *testing.T) {
+	for _, line := range []string{
+		`alice:ssh-ed25519 AAAA google-ssh {"expireOn":`,
+		`alice:ssh-ed25519 AAAA google-ssh {"expireOn":"tomorrow"}`,
+	} {
+		if got, err := gceKeyLine(line, time.Now()); err == nil {
+			t.Errorf("gceKeyLine(%q) = %q, want error", line, got)
+		}
+	}
+}
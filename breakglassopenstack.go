@@ -0,0 +1,89 @@
+// Code for interacting with OpenStack (and cloud-init config drives).
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const openStackMetadataURL = "http://169.254.169.254/openstack/latest/meta_data.json"
+
+// newOpenStackKeySource returns a key source which reads meta_data.json from
+// the OpenStack metadata service, or, if u has a path, from the config drive
+// mounted at that path (e.g. openstack:///mnt/config).
+func newOpenStackKeySource(u *url.URL) (keySource, error) {
+	if u.Path != "" {
+		path := filepath.Join(u.Path, "openstack", "latest", "meta_data.json")
+		return keySourceFunc(func() ([]byte, error) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			return openStackSSHKeys(b)
+		}), nil
+	}
+	return keySourceFunc(func() ([]byte, error) {
+		res, err := keySourceClient.Get(openStackMetadataURL)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: unexpected HTTP status %v", openStackMetadataURL, res.Status)
+		}
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return openStackSSHKeys(b)
+	}), nil
+}
+
+// openStackSSHKeys extracts the SSH public keys from an OpenStack
+// meta_data.json document and returns them one per line.
+//
+// See https://docs.openstack.org/nova/latest/user/metadata.html
+func openStackSSHKeys(metadata []byte) ([]byte, error) {
+	var md struct {
+		PublicKeys map[string]string `json:"public_keys"`
+		Keys       []struct {
+			Type string `json:"type"`
+			Data string `json:"data"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(metadata, &md); err != nil {
+		return nil, fmt.Errorf("parsing meta_data.json: %v", err)
+	}
+	var lines []string
+	seen := make(map[string]bool)
+	add := func(key string) {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		lines = append(lines, key)
+	}
+	for _, k := range md.Keys {
+		if k.Type == "ssh" {
+			add(k.Data)
+		}
+	}
+	names := make([]string, 0, len(md.PublicKeys))
+	for name := range md.PublicKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(md.PublicKeys[name])
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// builtinCommands are implemented within breakglass itself and are invoked
+// via exec requests of the form “breakglass <command> [args…]”, for example
+// by the breakglass client.
+var builtinCommands = map[string]func(s *session, args []string) error{
+	"sessions":  builtinSessions,
+	"recording": builtinRecording,
+	"list":      builtinList,
+	"attach":    builtinAttach,
+	"gok":       builtinGok,
+}
+
+// errAttached is returned by builtin commands which handed the channel over
+// to a ptySession, which reports the exit status instead.
+var errAttached = errors.New("attached to PTY session")
+
+// runBuiltin runs the builtin command specified by cmdline, reports its exit
+// status and closes the channel.
+func (s *session) runBuiltin(req *ssh.Request, cmdline []string) error {
+	if len(cmdline) < 2 {
+		return fmt.Errorf("syntax: breakglass <command> [args…]")
+	}
+	fn, ok := builtinCommands[cmdline[1]]
+	if !ok {
+		return fmt.Errorf("unknown breakglass command %q", cmdline[1])
+	}
+	req.Reply(true, nil)
+	var status exitStatus
+	if err := fn(s, cmdline[2:]); err == errAttached {
+		return nil
+	} else if err != nil {
+		fmt.Fprintf(s.channel.Stderr(), "breakglass %s: %v\n", cmdline[1], err)
+		status.Status = 1
+	}
+	// See https://tools.ietf.org/html/rfc4254#section-6.10
+	if _, err := s.channel.SendRequest("exit-status", false /* wantReply */, ssh.Marshal(status)); err != nil {
+		return err
+	}
+	return s.channel.Close()
+}
+
+// recordingPath returns the path of the recording with the specified ID.
+func recordingPath(id string) (string, error) {
+	if *recordDir == "" {
+		return "", fmt.Errorf("session recording is disabled (see -record_dir)")
+	}
+	if id == "" || strings.HasPrefix(id, ".") || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid session ID %q", id)
+	}
+	return filepath.Join(*recordDir, id+".cast"), nil
+}
+
+// recordingDuration returns the time offset of the last event in the
+// recording, reading only the end of the file.
+func recordingDuration(f *os.File, size int64) time.Duration {
+	const tail = 64 * 1024
+	offset := max(size-tail, 0)
+	b := make([]byte, size-offset)
+	if _, err := f.ReadAt(b, offset); err != nil && err != io.EOF {
+		return 0
+	}
+	lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+	var ev []any
+	if err := json.Unmarshal(lines[len(lines)-1], &ev); err != nil || len(ev) < 1 {
+		return 0
+	}
+	secs, _ := ev[0].(float64)
+	return time.Duration(secs * float64(time.Second)).Round(time.Second)
+}
+
+// builtinSessions lists the recorded sessions.
+func builtinSessions(s *session, args []string) error {
+	if s.opts.credential != nil {
+		return fmt.Errorf("not permitted for unprivileged users")
+	}
+	if *recordDir == "" {
+		return fmt.Errorf("session recording is disabled (see -record_dir)")
+	}
+	matches, err := filepath.Glob(filepath.Join(*recordDir, "*.cast"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(matches)
+	tw := tabwriter.NewWriter(s.channel, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tSTARTED\tDURATION\tSIZE\tCOMMAND\n")
+	for _, match := range matches {
+		f, err := os.Open(match)
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		var hdr asciicastHeader
+		if line, err := bufio.NewReader(f).ReadBytes('\n'); err == nil {
+			json.Unmarshal(line, &hdr)
+		}
+		duration := recordingDuration(f, st.Size())
+		f.Close()
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%d\t%s\n",
+			strings.TrimSuffix(filepath.Base(match), ".cast"),
+			time.Unix(hdr.Timestamp, 0).Format(time.DateTime),
+			duration,
+			st.Size(),
+			hdr.Command)
+	}
+	return tw.Flush()
+}
+
+// builtinRecording writes the recording with the specified ID to stdout.
+func builtinRecording(s *session, args []string) error {
+	if s.opts.credential != nil {
+		return fmt.Errorf("not permitted for unprivileged users")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("syntax: breakglass recording <id>")
+	}
+	path, err := recordingPath(args[0])
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.audit.Info("recording fetched", "session", args[0])
+	_, err = io.Copy(s.channel, f)
+	return err
+}
+
+// builtinList lists the PTY sessions.
+func builtinList(s *session, args []string) error {
+	tw := tabwriter.NewWriter(s.channel, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tSTARTED\tSTATE\tCOMMAND\n")
+	for _, ps := range listPTYSessions(s) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			ps.id,
+			ps.started.Format(time.DateTime),
+			ps.state(),
+			ps.command)
+	}
+	return tw.Flush()
+}
+
+// builtinAttach attaches the session to the PTY session with the specified
+// ID, in addition to the clients which are already attached. With -r, the
+// session is only watched and input is discarded. With -d, all other clients
+// are detached, which read-only clients may not do.
+func builtinAttach(s *session, args []string) error {
+	const syntax = "syntax: breakglass attach [-r] [-d] <id>"
+	var readOnly, exclusive bool
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-r":
+			readOnly = true
+		case "-d":
+			exclusive = true
+		default:
+			return fmt.Errorf(syntax)
+		}
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return fmt.Errorf(syntax)
+	}
+	if readOnly && exclusive {
+		// Detaching the writers would hang up the session.
+		return fmt.Errorf("-r and -d are mutually exclusive")
+	}
+	if s.ptyf == nil && !readOnly {
+		return fmt.Errorf("attaching requires a PTY (use ssh -t, or -r to watch)")
+	}
+	ps, err := lookupPTYSession(s, args[0])
+	if err != nil {
+		return err
+	}
+	// The PTY allocated for this session (if any) is not used.
+	ptyf, ttyf := s.ptyf, s.ttyf
+	if err := ps.attach(s, readOnly, exclusive); err != nil {
+		return err
+	}
+	if ptyf != nil {
+		if s.ptyf == ptyf {
+			s.ptyf = nil
+		}
+		ptyf.Close()
+		ttyf.Close()
+		s.ttyf = nil
+	}
+	s.audit.Info("attach", "session", ps.id, "read_only", readOnly, "exclusive", exclusive)
+	return errAttached
+}
+
+// builtinGok controls the services of the gokrazy instance, see runGok.
+func builtinGok(s *session, args []string) error {
+	if s.opts.credential != nil {
+		// The on-device API grants full control over the instance.
+		return fmt.Errorf("not permitted for unprivileged users")
+	}
+	s.audit.Info("gok", "args", args)
+	return runGok(context.Background(), s.channel, s.channel.Stderr(), args)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loadTrustedUserCAKeys returns the public keys listed in the file at path,
+// which uses the same format as OpenSSH’s TrustedUserCAKeys file.
+func loadTrustedUserCAKeys(path string) (map[string]bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool)
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if tr := strings.TrimSpace(s.Text()); tr == "" || strings.HasPrefix(tr, "#") {
+			continue
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(s.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		result[string(pubKey.Marshal())] = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// certOptions translates the critical options and extensions of a user
+// certificate into keyOptions. The source-address critical option is
+// enforced by the ssh package itself.
+func certOptions(cert *ssh.Certificate) *keyOptions {
+	_, permitPTY := cert.Extensions["permit-pty"]
+	_, permitPortForwarding := cert.Extensions["permit-port-forwarding"]
+	_, permitAgentForwarding := cert.Extensions["permit-agent-forwarding"]
+	return &keyOptions{
+		command:           cert.CriticalOptions["force-command"],
+		noPTY:             !permitPTY,
+		noPortForwarding:  !permitPortForwarding,
+		noAgentForwarding: !permitAgentForwarding,
+	}
+}
+
+// newCertChecker returns an ssh.CertChecker which accepts user certificates
+// signed by one of caKeys and delegates all other keys to fallback.
+func newCertChecker(caKeys map[string]bool, fallback func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) *ssh.CertChecker {
+	return &ssh.CertChecker{
+		SupportedCriticalOptions: []string{"force-command", "source-address"},
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return caKeys[string(auth.Marshal())]
+		},
+		UserKeyFallback: fallback,
+	}
+}
+
+// authenticateCert wraps (*ssh.CertChecker).Authenticate to require at least
+// one principal (like OpenSSH does without an AuthorizedPrincipalsFile) and
+// to attach the keyOptions of the certificate to the connection.
+func authenticateCert(checker *ssh.CertChecker, conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return checker.Authenticate(conn, pubKey)
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate %q has no principals", cert.KeyId)
+	}
+	if _, err := checker.Authenticate(conn, pubKey); err != nil {
+		return nil, err
+	}
+	perms := certOptions(cert).permissions()
+	// Retain the critical options so that the ssh package enforces
+	// source-address.
+	perms.CriticalOptions = cert.CriticalOptions
+	return perms, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// listPTYSessions prints the PTY sessions running on hostname.
+func (bg *bg) listPTYSessions(hostname string) error {
+	ssh := bg.sshCommand(hostname, false, "list")
+	ssh.Stdout = os.Stdout
+	ssh.Stderr = os.Stderr
+	if err := ssh.Run(); err != nil {
+		return fmt.Errorf("%v: %v", ssh.Args, err)
+	}
+	return nil
+}
+
+// attach attaches to a PTY session on hostname. args are passed to the
+// attach builtin, i.e. the session ID, optionally preceded by -r (read-only)
+// or -d (detach other clients).
+func (bg *bg) attach(hostname string, args ...string) error {
+	ssh := bg.sshCommand(hostname, true, append([]string{"attach"}, args...)...)
+	ssh.Stdin = os.Stdin
+	ssh.Stdout = os.Stdout
+	ssh.Stderr = os.Stderr
+	if err := ssh.Run(); err != nil {
+		return fmt.Errorf("%v: %v", ssh.Args, err)
+	}
+	return nil
+}
@@ -5,6 +5,11 @@
 //
 //	breakglass gokrazy
 //	breakglass -debug_tarball_pattern=$HOME/gokrazy/debug-\${GOARCH}.tar gokrazy
+//	breakglass -sessions gokrazy
+//	breakglass -replay=20240101-120000-1a2b3c4d gokrazy
+//	breakglass -list gokrazy
+//	breakglass -attach=20240101-120000-1a2b3c4d gokrazy
+//	breakglass -watch=20240101-120000-1a2b3c4d gokrazy
 package main
 
 import (
@@ -204,6 +209,41 @@ func breakglass() error {
 			"ssh_config",
 			"",
 			"an alternative per-user configuration file for ssh and scp")
+
+		sessions = flag.Bool(
+			"sessions",
+			false,
+			"list the recorded sessions instead of starting a shell")
+
+		replay = flag.String(
+			"replay",
+			"",
+			"if non-empty, play back the recorded session with this ID instead of starting a shell")
+
+		replaySpeed = flag.Float64(
+			"replay_speed",
+			1,
+			"playback speed factor for -replay")
+
+		list = flag.Bool(
+			"list",
+			false,
+			"list the running PTY sessions instead of starting a shell")
+
+		attach = flag.String(
+			"attach",
+			"",
+			"if non-empty, join (or reattach to) the PTY session with this ID instead of starting a shell")
+
+		watch = flag.String(
+			"watch",
+			"",
+			"if non-empty, join the PTY session with this ID read-only instead of starting a shell")
+
+		detachOthers = flag.Bool(
+			"detach_others",
+			false,
+			"with -attach, detach all other clients of the session (e.g. a previous connection which broke)")
 	)
 
 	flag.Usage = func() {
@@ -211,17 +251,39 @@ func breakglass() error {
 
 		fmt.Fprintf(os.Stderr, "  breakglass gokrazy\n")
 		fmt.Fprintf(os.Stderr, "  breakglass -debug_tarball_pattern=$HOME/gokrazy/debug-\\${GOARCH}.tar gokrazy\n")
+		fmt.Fprintf(os.Stderr, "  breakglass -sessions gokrazy                         # list recorded sessions\n")
+		fmt.Fprintf(os.Stderr, "  breakglass -replay=<session> gokrazy                 # play back a recorded session\n")
+		fmt.Fprintf(os.Stderr, "  breakglass -list gokrazy                             # list PTY sessions\n")
+		fmt.Fprintf(os.Stderr, "  breakglass -attach=<session> gokrazy                 # join (or reattach to) a PTY session\n")
+		fmt.Fprintf(os.Stderr, "  breakglass -attach=<session> -detach_others gokrazy  # ... detaching all other clients\n")
+		fmt.Fprintf(os.Stderr, "  breakglass -watch=<session> gokrazy                  # join a PTY session read-only\n")
 
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
-	if flag.NArg() < 1 {
-		log.Fatalf("syntax: breakglass <hostname> [command]")
+	args := flag.Args()
+	if len(args) < 1 {
+		log.Fatalf("syntax: breakglass [flags] <hostname> [command]")
+	}
+	modes := 0
+	for _, set := range []bool{*sessions, *replay != "", *list, *attach != "", *watch != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("-sessions, -replay, -list, -attach and -watch are mutually exclusive")
+	}
+	if *detachOthers && *attach == "" {
+		return fmt.Errorf("-detach_others requires -attach")
+	}
+	if modes > 0 && len(args) > 1 {
+		return fmt.Errorf("unexpected arguments after the hostname: %q", args[1:])
 	}
 
-	instance := flag.Arg(0)
+	instance := args[0]
 	instanceflag.SetInstance(instance)
 
 	cfg, err := config.ApplyInstanceFlag()
@@ -260,6 +322,21 @@ func breakglass() error {
 		return err
 	}
 
+	switch {
+	case *sessions:
+		return bg.listSessions(hostname)
+	case *replay != "":
+		return bg.replay(hostname, *replay, *replaySpeed)
+	case *list:
+		return bg.listPTYSessions(hostname)
+	case *attach != "" && *detachOthers:
+		return bg.attach(hostname, "-d", *attach)
+	case *attach != "":
+		return bg.attach(hostname, *attach)
+	case *watch != "":
+		return bg.attach(hostname, "-r", *watch)
+	}
+
 	if err := bg.uploadDebugTarball(*debugTarballPattern); err != nil {
 		return err
 	}
@@ -280,7 +357,7 @@ func breakglass() error {
 	}
 
 	ssh := exec.Command("ssh", hostname)
-	if args := flag.Args()[1:]; len(args) > 0 {
+	if args := args[1:]; len(args) > 0 {
 		ssh.Args = append(ssh.Args, args...)
 	}
 	log.Printf("%v", ssh.Args)
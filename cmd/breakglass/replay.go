@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sshCommand returns an ssh(1) invocation which runs the breakglass builtin
+// command args on hostname, in a PTY if tty is true.
+func (bg *bg) sshCommand(hostname string, tty bool, args ...string) *exec.Cmd {
+	var opts []string
+	if bg.sshConfig != "" {
+		opts = append(opts, "-F", bg.sshConfig)
+	}
+	if tty {
+		opts = append(opts, "-t")
+	}
+	opts = append(opts, hostname, "breakglass")
+	return exec.Command("ssh", append(opts, args...)...)
+}
+
+// listSessions prints the session recordings stored on hostname.
+func (bg *bg) listSessions(hostname string) error {
+	ssh := bg.sshCommand(hostname, false, "sessions")
+	ssh.Stdout = os.Stdout
+	ssh.Stderr = os.Stderr
+	if err := ssh.Run(); err != nil {
+		return fmt.Errorf("%v: %v", ssh.Args, err)
+	}
+	return nil
+}
+
+// replay fetches the session recording with the specified ID from hostname
+// and plays it back on stdout.
+func (bg *bg) replay(hostname, id string, speed float64) error {
+	ssh := bg.sshCommand(hostname, false, "recording", id)
+	ssh.Stderr = os.Stderr
+	stdout, err := ssh.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := ssh.Start(); err != nil {
+		return fmt.Errorf("%v: %v", ssh.Args, err)
+	}
+	if err := play(stdout, os.Stdout, speed); err != nil {
+		ssh.Process.Kill()
+		ssh.Wait()
+		return err
+	}
+	if err := ssh.Wait(); err != nil {
+		return fmt.Errorf("%v: %v", ssh.Args, err)
+	}
+	return nil
+}
+
+// resizeTerminal asks the terminal to resize itself (supported by xterm and
+// many other terminal emulators) and warns if the terminal is smaller than
+// the recording.
+func resizeTerminal(w *os.File, width, height int) {
+	fmt.Fprintf(w, "\x1b[8;%d;%dt", height, width)
+	ws, err := unix.IoctlGetWinsize(int(w.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return // not a terminal
+	}
+	if int(ws.Col) < width || int(ws.Row) < height {
+		fmt.Fprintf(os.Stderr, "warning: terminal is %dx%d, but the recording is %dx%d\n", ws.Col, ws.Row, width, height)
+	}
+}
+
+// play plays back an asciicast v2 recording with its original timing,
+// divided by speed.
+func play(r io.Reader, w *os.File, speed float64) error {
+	if speed <= 0 {
+		speed = 1
+	}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("empty recording")
+	}
+	var hdr struct {
+		Version int `json:"version"`
+		Width   int `json:"width"`
+		Height  int `json:"height"`
+	}
+	if err := json.Unmarshal(s.Bytes(), &hdr); err != nil {
+		return fmt.Errorf("parsing asciicast header: %v", err)
+	}
+	if hdr.Version != 2 {
+		return fmt.Errorf("unsupported asciicast version %d", hdr.Version)
+	}
+	if hdr.Width > 0 && hdr.Height > 0 {
+		resizeTerminal(w, hdr.Width, hdr.Height)
+	}
+
+	start := time.Now()
+	for s.Scan() {
+		var ev []any
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			return fmt.Errorf("parsing asciicast event: %v", err)
+		}
+		if len(ev) != 3 {
+			continue
+		}
+		secs, _ := ev[0].(float64)
+		typ, _ := ev[1].(string)
+		data, _ := ev[2].(string)
+		due := start.Add(time.Duration(secs / speed * float64(time.Second)))
+		time.Sleep(time.Until(due))
+		switch typ {
+		case "o":
+			if _, err := io.WriteString(w, data); err != nil {
+				return err
+			}
+		case "r":
+			var width, height int
+			if _, err := fmt.Sscanf(data, "%dx%d", &width, &height); err == nil {
+				resizeTerminal(w, width, height)
+			}
+		case "m":
+			fmt.Fprintf(os.Stderr, "\r\n[%s]\r\n", data)
+		}
+	}
+	return s.Err()
+}
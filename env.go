@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// acceptEnv reports whether the client may set the environment variable
+// name, i.e. whether name matches one of the -accept_env patterns.
+func acceptEnv(name string) bool {
+	for _, pattern := range strings.Split(*acceptEnvPatterns, ",") {
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serverEnv are the variables of -env_file, which is read once on startup.
+var serverEnv []string
+
+// loadEnvFile reads environment variables from path, one NAME=value per
+// line. Empty lines and lines starting with # are ignored, as are
+// surrounding double quotes of values. A missing file is not an error.
+func loadEnvFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var env []string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, val, ok := strings.Cut(line, "=")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: syntax error: want NAME=value", path, lineno)
+		}
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			val = val[1 : len(val)-1]
+		}
+		env = append(env, name+"="+val)
+	}
+	return env, s.Err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAcceptEnv(t *testing.T) {
+	defer func(old string) { *acceptEnvPatterns = old }(*acceptEnvPatterns)
+	for _, tt := range []struct {
+		patterns string
+		name     string
+		want     bool
+	}{
+		{"LANG,LC_*", "LANG", true},
+		{"LANG,LC_*", "LC_ALL", true},
+		{"LANG,LC_*", "LANGUAGE", false},
+		{"LANG,LC_*", "LD_PRELOAD", false},
+		{"LANG,LC_*", "PATH", false},
+		{"", "LANG", false},
+		{"LANG,,TZ", "TZ", true},
+		{"*", "LD_PRELOAD", true},
+	} {
+		*acceptEnvPatterns = tt.patterns
+		if got := acceptEnv(tt.name); got != tt.want {
+			t.Errorf("-accept_env=%q: acceptEnv(%q) = %v, want %v", tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			content: "",
+			want:    nil,
+		},
+		{
+			name: "variables",
+			content: `# comment
+HTTP_PROXY=http://proxy:3128
+
+export TZ=Europe/Zurich
+GREETING="hello world"
+EMPTY=
+EQUALS=a=b
+`,
+			want: []string{
+				"HTTP_PROXY=http://proxy:3128",
+				"TZ=Europe/Zurich",
+				"GREETING=hello world",
+				"EMPTY=",
+				"EQUALS=a=b",
+			},
+		},
+		{
+			name:    "missing equals sign",
+			content: "FOO\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty name",
+			content: "=value\n",
+			wantErr: true,
+		},
+		{
+			name:    "space in name",
+			content: "FOO BAR=value\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadEnvFile(path)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("loadEnvFile() = %v, want error: %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("loadEnvFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnvFileMissing(t *testing.T) {
+	env, err := loadEnvFile(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || env != nil {
+		t.Errorf("loadEnvFile(missing) = %q, %v, want nil, nil", env, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gokrazy/gokrazy"
+)
+
+// forwardRule permits (or, if deny is set, prohibits) port forwarding to
+// and from matching host:port addresses.
+type forwardRule struct {
+	deny bool
+
+	// Exactly one of the following host matchers is set; none matches any
+	// host.
+	network *net.IPNet
+	class   string // loopback or private-network
+	pattern string // hostname glob, compared with the requested address
+
+	portLo, portHi uint32
+}
+
+// forwardingPolicy is the parsed -forward flag.
+var forwardingPolicy forwardPolicy
+
+// forwardPolicy is an ordered list of forwardRules. The first matching rule
+// decides; addresses which match no rule are denied.
+type forwardPolicy []forwardRule
+
+// parseForwardPolicy parses a comma-separated list of rules of the form
+// [!]host[:port], where host is an IP address, a CIDR network (in brackets
+// for IPv6, e.g. [fd00::/8]:22), a hostname pattern, * or one of the
+// keywords loopback and private-network, and port is a port number, a port
+// range (e.g. 6000-6100) or * (the default).
+func parseForwardPolicy(s string) (forwardPolicy, error) {
+	var p forwardPolicy
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		r, err := parseForwardRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("forwarding rule %q: %v", entry, err)
+		}
+		p = append(p, r)
+	}
+	return p, nil
+}
+
+func parseForwardRule(entry string) (forwardRule, error) {
+	var r forwardRule
+	if rest, ok := strings.CutPrefix(entry, "!"); ok {
+		r.deny = true
+		entry = rest
+	}
+	host, port := entry, "*"
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(entry, "[") {
+		if !strings.HasSuffix(entry, "]") {
+			return r, fmt.Errorf("missing ]")
+		}
+		host = entry[1 : len(entry)-1]
+	}
+
+	switch {
+	case host == "":
+		return r, fmt.Errorf("empty host")
+	case host == "*":
+		// matches any host
+	case host == "loopback" || host == "private-network":
+		r.class = host
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return r, err
+		}
+		r.network = network
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		if _, err := path.Match(host, ""); err != nil {
+			return r, err
+		}
+		r.pattern = strings.ToLower(host)
+	}
+
+	if port == "*" {
+		r.portLo, r.portHi = 0, 65535
+		return r, nil
+	}
+	lo, hi, isRange := strings.Cut(port, "-")
+	if !isRange {
+		hi = lo
+	}
+	plo, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return r, fmt.Errorf("invalid port %q", port)
+	}
+	phi, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || phi < plo {
+		return r, fmt.Errorf("invalid port %q", port)
+	}
+	r.portLo, r.portHi = uint32(plo), uint32(phi)
+	return r, nil
+}
+
+// matches reports whether r applies to port on host (as requested by the
+// client), which resolved to ip (nil if unresolved).
+func (r *forwardRule) matches(host string, ip net.IP, port uint32) bool {
+	if port < r.portLo || port > r.portHi {
+		return false
+	}
+	switch {
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case r.class == "loopback":
+		return ip != nil && ip.IsLoopback()
+	case r.class == "private-network":
+		return ip != nil && (ip.IsLoopback() || gokrazy.IsInPrivateNet(ip))
+	case r.pattern != "":
+		ok, _ := path.Match(r.pattern, strings.ToLower(host))
+		return ok
+	}
+	return true
+}
+
+// allows reports whether the first rule matching host, ip and port permits
+// forwarding. Hostname patterns are matched against the requested host, but
+// the connection is made to the address it resolved to, which the owner of
+// a domain can change at will (DNS rebinding). Hence, a hostname rule only
+// permits forwarding if ip is not denied by any address rule.
+func (p forwardPolicy) allows(host string, ip net.IP, port uint32) bool {
+	for _, r := range p {
+		if !r.matches(host, ip, port) {
+			continue
+		}
+		if r.deny {
+			return false
+		}
+		return r.pattern == "" || !p.deniesAddr(ip, port)
+	}
+	return false
+}
+
+// deniesAddr reports whether a deny rule for an IP address, network or
+// address class matches ip and port.
+func (p forwardPolicy) deniesAddr(ip net.IP, port uint32) bool {
+	for _, r := range p {
+		if r.deny && (r.network != nil || r.class != "") && r.matches("", ip, port) {
+			return true
+		}
+	}
+	return false
+}
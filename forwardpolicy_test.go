@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseForwardPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int // number of rules
+	}{
+		{"", 0},
+		{"loopback", 1},
+		{"loopback, private-network", 2},
+		{"127.0.0.1:6060,127.0.0.1:9090", 2},
+		{"!10.0.0.0/8,*", 2},
+		{"[fd00::/8]:22", 1},
+		{"[::1]:8080", 1},
+		{"::1", 1},
+		{"*.example.com:8000-8100", 1},
+		{"*:*", 1},
+	} {
+		p, err := parseForwardPolicy(tt.in)
+		if err != nil {
+			t.Errorf("parseForwardPolicy(%q): %v", tt.in, err)
+			continue
+		}
+		if len(p) != tt.want {
+			t.Errorf("parseForwardPolicy(%q) = %d rules, want %d", tt.in, len(p), tt.want)
+		}
+	}
+}
+
+func TestParseForwardPolicyErrors(t *testing.T) {
+	for _, in := range []string{
+		"!",
+		":8080",
+		"10.0.0.0/33",
+		"[fd00::/8",
+		"127.0.0.1:http",
+		"127.0.0.1:65536",
+		"127.0.0.1:9090-8080",
+		"[a-:80",
+	} {
+		if p, err := parseForwardPolicy(in); err == nil {
+			t.Errorf("parseForwardPolicy(%q) = %+v, want error", in, p)
+		}
+	}
+}
+
+func TestForwardPolicyAllows(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		host   string
+		ip     string
+		port   uint32
+		want   bool
+	}{
+		{"", "127.0.0.1", "127.0.0.1", 80, false},
+		{"loopback", "localhost", "127.0.0.1", 80, true},
+		{"loopback", "10.0.0.1", "10.0.0.1", 80, false},
+		{"private-network", "10.0.0.1", "10.0.0.1", 80, true},
+		{"private-network", "192.0.2.1", "192.0.2.1", 80, false},
+		{"127.0.0.1:6060,127.0.0.1:9090", "127.0.0.1", "127.0.0.1", 9090, true},
+		{"127.0.0.1:6060,127.0.0.1:9090", "127.0.0.1", "127.0.0.1", 8080, false},
+		{"127.0.0.1:8000-8100", "127.0.0.1", "127.0.0.1", 8100, true},
+		{"127.0.0.1:8000-8100", "127.0.0.1", "127.0.0.1", 8101, false},
+		{"!10.0.0.1,10.0.0.0/8", "10.0.0.1", "10.0.0.1", 80, false},
+		{"!10.0.0.1,10.0.0.0/8", "10.0.0.2", "10.0.0.2", 80, true},
+		{"10.0.0.0/8,!10.0.0.1", "10.0.0.1", "10.0.0.1", 80, true}, // first match
+		{"[fd00::/8]:22", "fd00::1", "fd00::1", 22, true},
+		{"*", "example.net", "192.0.2.1", 80, true},
+
+		// Hostname patterns match the requested name, case-insensitively.
+		{"*.example.com", "www.EXAMPLE.com", "192.0.2.1", 80, true},
+		{"*.example.com", "example.net", "192.0.2.1", 80, false},
+		{"*.example.com", "unresolved.example.com", "", 80, true},
+
+		// Address deny rules take precedence over hostname rules, so that
+		// a name cannot be made to resolve to a denied address.
+		{"*.example.com,!loopback", "www.example.com", "127.0.0.1", 80, false},
+		{"*.example.com,!10.0.0.0/8", "www.example.com", "10.1.2.3", 80, false},
+		{"*.example.com,!10.0.0.0/8:22", "www.example.com", "10.1.2.3", 80, true},
+		{"*.example.com,!*.example.net", "www.example.com", "10.1.2.3", 80, true},
+		{"*.example.com,!*", "www.example.com", "10.1.2.3", 80, true},
+	} {
+		p, err := parseForwardPolicy(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := net.ParseIP(tt.ip)
+		if got := p.allows(tt.host, ip, tt.port); got != tt.want {
+			t.Errorf("-forward=%q: allows(%q, %s, %d) = %v, want %v", tt.policy, tt.host, ip, tt.port, got, tt.want)
+		}
+	}
+}
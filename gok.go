@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/gokapi"
+	"github.com/gokrazy/gokapi/ondeviceapi"
+)
+
+const gokUsage = `syntax: gok <command> [args…]
+
+  gok services                                 list services
+  gok status <service>                         show the status of a service
+  gok logs [-f] [-stream=stdout|stderr] <service>
+                                               show the log of a service
+  gok restart <service>                        (re)start a service
+  gok stop <service>                           stop a service
+  gok reboot                                   reboot the gokrazy instance
+
+Services can be specified by path (/user/foo) or name (foo).
+`
+
+// gokLogIdle is how long gok logs waits for further lines before it assumes
+// that all buffered lines were received (the gokrazy log endpoint streams the
+// buffered lines, followed by new lines as they are logged).
+const gokLogIdle = 500 * time.Millisecond
+
+// gokMain is the entry point of the gok multi-call mode of breakglass, which
+// breakglass makes available in the PATH of all sessions.
+func gokMain(args []string) int {
+	if os.Geteuid() != 0 {
+		// The on-device API grants full control over the instance, see
+		// builtinGok.
+		fmt.Fprintf(os.Stderr, "gok: not permitted for unprivileged users\n")
+		return 1
+	}
+	if err := runGok(context.Background(), os.Stdout, os.Stderr, args); err != nil {
+		fmt.Fprintf(os.Stderr, "gok: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runGok controls the services of the gokrazy instance, like the gok CLI does
+// from the outside.
+//
+// Only listing services and showing their status use the on-device API. It
+// does not cover logs, stop, restart and reboot, so these send hand-rolled
+// HTTP requests to the web interface (see log and post), and stop and
+// restart scrape the XSRF token from a cookie of the status page (see
+// xsrfToken). Changes to the web interface may break these commands.
+func runGok(ctx context.Context, stdout, stderr io.Writer, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, gokUsage)
+		return fmt.Errorf("missing command")
+	}
+	g, err := newGokClient()
+	if err != nil {
+		return err
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "services":
+		return g.services(ctx, stdout)
+
+	case "status":
+		if len(args) != 1 {
+			return fmt.Errorf("syntax: gok status <service>")
+		}
+		return g.status(ctx, stdout, args[0])
+
+	case "logs":
+		fset := flag.NewFlagSet("logs", flag.ContinueOnError)
+		fset.SetOutput(stderr)
+		follow := fset.Bool("f", false, "follow the log")
+		stream := fset.String("stream", "", "only show stdout or stderr")
+		if err := fset.Parse(args); err != nil {
+			return err
+		}
+		if fset.NArg() != 1 {
+			return fmt.Errorf("syntax: gok logs [-f] [-stream=stdout|stderr] <service>")
+		}
+		return g.logs(ctx, stdout, stderr, fset.Arg(0), *stream, *follow)
+
+	case "restart", "stop":
+		if len(args) != 1 {
+			return fmt.Errorf("syntax: gok %s <service>", cmd)
+		}
+		return g.stopStart(ctx, stdout, cmd, args[0])
+
+	case "reboot":
+		return g.reboot(ctx, stdout)
+
+	default:
+		fmt.Fprint(stderr, gokUsage)
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// gokClient talks to the gokrazy instance, using api where possible and
+// plain HTTP requests to base otherwise.
+type gokClient struct {
+	api  *ondeviceapi.APIClient
+	base string // including credentials
+	hc   *http.Client
+}
+
+func newGokClient() (*gokClient, error) {
+	cfg, err := gokapi.ConnectOnDevice()
+	if err != nil {
+		return nil, err
+	}
+	hc := http.DefaultClient
+	if cfg.HTTPClient != nil {
+		hc = cfg.HTTPClient
+	}
+	return &gokClient{
+		api:  ondeviceapi.NewAPIClient(cfg),
+		base: strings.TrimSuffix(cfg.BasePath, "/"),
+		hc:   hc,
+	}, nil
+}
+
+// resolve returns the path of the service specified by path or name.
+func (g *gokClient) resolve(ctx context.Context, service string) (string, error) {
+	if strings.HasPrefix(service, "/") {
+		return service, nil
+	}
+	idx, _, err := g.api.SuperviseApi.Index(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, svc := range idx.Services {
+		if filepath.Base(svc.Path) == service {
+			return svc.Path, nil
+		}
+	}
+	return "", fmt.Errorf("service %q not found", service)
+}
+
+// serviceState describes whether svc is running, and since when.
+func serviceState(svc ondeviceapi.Service) string {
+	if svc.Stopped {
+		return "stopped"
+	}
+	if t, err := time.Parse(time.RFC3339Nano, svc.StartTime); err == nil && !t.IsZero() {
+		return "running since " + t.Format(time.DateTime)
+	}
+	return "running"
+}
+
+func (g *gokClient) services(ctx context.Context, w io.Writer) error {
+	idx, _, err := g.api.SuperviseApi.Index(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "SERVICE\tSTATE\n")
+	for _, svc := range idx.Services {
+		fmt.Fprintf(tw, "%s\t%s\n", svc.Path, serviceState(svc))
+	}
+	return tw.Flush()
+}
+
+func (g *gokClient) status(ctx context.Context, w io.Writer, service string) error {
+	path, err := g.resolve(ctx, service)
+	if err != nil {
+		return err
+	}
+	svc, _, err := g.api.SuperviseApi.Status(ctx, path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	fmt.Fprintf(w, "service: %s\n", svc.Path)
+	fmt.Fprintf(w, "state:   %s\n", serviceState(svc))
+	fmt.Fprintf(w, "args:    %q\n", svc.Args)
+	if svc.Diverted != "" {
+		fmt.Fprintf(w, "diverted: %s\n", svc.Diverted)
+	}
+	return nil
+}
+
+func (g *gokClient) url(endpoint string, query url.Values) string {
+	return g.base + "/" + endpoint + "?" + query.Encode()
+}
+
+// logs prints the stdout and stderr ring buffers of the service (or only
+// the specified stream), following new lines if follow is true.
+func (g *gokClient) logs(ctx context.Context, stdout, stderr io.Writer, service, stream string, follow bool) error {
+	path, err := g.resolve(ctx, service)
+	if err != nil {
+		return err
+	}
+	streams := map[string]io.Writer{"stdout": stdout, "stderr": stderr}
+	if stream != "" {
+		w, ok := streams[stream]
+		if !ok {
+			return fmt.Errorf("unknown stream %q (want stdout or stderr)", stream)
+		}
+		streams = map[string]io.Writer{stream: w}
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result error
+	)
+	for name, w := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := g.log(ctx, w, path, name, follow); err != nil {
+				mu.Lock()
+				result = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+func (g *gokClient) log(ctx context.Context, w io.Writer, path, stream string, follow bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", g.url("log", url.Values{
+		"path":   []string{path},
+		"stream": []string{stream},
+	}), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var idle *time.Timer
+	if !follow {
+		idle = time.AfterFunc(gokLogIdle, cancel)
+		defer idle.Stop()
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if idle != nil {
+			idle.Reset(gokLogIdle)
+		}
+		if _, err := fmt.Fprintln(w, scanner.Text()); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil // done reading the buffered lines, or interrupted
+	}
+	return scanner.Err()
+}
+
+// xsrfToken returns a token for requests which modify the state of the
+// gokrazy instance. The web interface sets it as a cookie on status pages.
+func (g *gokClient) xsrfToken(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", g.url("status", url.Values{"path": []string{path}}), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := g.hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	for _, c := range resp.Cookies() {
+		if c.Name == "gokrazy_xsrf" {
+			return c.Value, nil
+		}
+	}
+	return "", fmt.Errorf("%s: no XSRF token in response", resp.Status)
+}
+
+// post sends a form to the specified endpoint of the web interface and
+// returns the response body.
+func (g *gokClient) post(ctx context.Context, endpoint string, form url.Values, token string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", g.base+"/"+endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: "gokrazy_xsrf", Value: token})
+	}
+	// Do not follow the redirect to the status page of the service.
+	hc := *g.hc
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+func (g *gokClient) stopStart(ctx context.Context, w io.Writer, cmd, service string) error {
+	path, err := g.resolve(ctx, service)
+	if err != nil {
+		return err
+	}
+	token, err := g.xsrfToken(ctx, path)
+	if err != nil {
+		return err
+	}
+	if _, err := g.post(ctx, cmd, url.Values{
+		"path":      []string{path},
+		"xsrftoken": []string{token},
+	}, token); err != nil {
+		return fmt.Errorf("%s %s: %v", cmd, path, err)
+	}
+	svc, _, err := g.api.SuperviseApi.Status(ctx, path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: %s\n", path, serviceState(svc))
+	return nil
+}
+
+func (g *gokClient) reboot(ctx context.Context, w io.Writer) error {
+	b, err := g.post(ctx, "reboot", url.Values{}, "")
+	if err != nil {
+		return fmt.Errorf("reboot: %v", err)
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// goShell is a minimal shell, used when the gokrazy installation contains
+// neither busybox nor any other sh (see findShell). breakglass runs it by
+// executing itself with argv[0] set to "sh".
+//
+// It supports pipes, redirections, && and ||, quoting, $VARIABLE expansion
+// and globbing, but no control structures, functions or job control. Shell
+// variables are always exported.
+func goShell(args []string) int {
+	sh := &shell{}
+	switch {
+	case len(args) >= 2 && args[0] == "-c":
+		sh.run(args[1])
+		return sh.status
+	case len(args) >= 1:
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sh: %v\n", err)
+			return 127
+		}
+		defer f.Close()
+		return sh.script(f)
+	case term.IsTerminal(int(os.Stdin.Fd())):
+		return sh.interactive()
+	default:
+		return sh.script(os.Stdin)
+	}
+}
+
+// shell is the state of the built-in shell.
+type shell struct {
+	status int  // exit status of the last pipeline
+	exited bool // exit was called
+}
+
+// script runs each line read from r.
+func (sh *shell) script(r io.Reader) int {
+	scanner := bufio.NewScanner(r)
+	for !sh.exited && scanner.Scan() {
+		sh.run(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "sh: %v\n", err)
+		return 1
+	}
+	return sh.status
+}
+
+// interruptReader records whether Ctrl-C was read, which term.Terminal
+// reports as io.EOF, just like Ctrl-D.
+type interruptReader struct {
+	r           io.Reader
+	interrupted atomic.Bool
+}
+
+func (ir *interruptReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if bytes.IndexByte(p[:n], 3) != -1 {
+		ir.interrupted.Store(true)
+	}
+	return n, err
+}
+
+// interactive reads commands from the terminal, with line editing and
+// history, until the user exits.
+func (sh *shell) interactive() int {
+	// Handle (instead of ignore) signals from the terminal, so that
+	// commands are started with the default handlers.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGQUIT)
+	go func() {
+		for range sigc {
+		}
+	}()
+
+	fd := int(os.Stdin.Fd())
+	in := &interruptReader{r: os.Stdin}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{in, os.Stdout}
+	t := term.NewTerminal(rw, "")
+	for !sh.exited {
+		t.SetPrompt(sh.prompt())
+		if w, h, err := term.GetSize(fd); err == nil && w > 0 && h > 0 {
+			t.SetSize(w, h)
+		}
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sh: %v\n", err)
+			return sh.script(os.Stdin)
+		}
+		line, err := t.ReadLine()
+		term.Restore(fd, state)
+		if err == io.EOF && in.interrupted.Swap(false) {
+			// Discard the line, but keep the history.
+			fmt.Fprintf(os.Stdout, "^C\n")
+			history := t.History
+			t = term.NewTerminal(rw, "")
+			t.History = history
+			continue
+		}
+		if err == io.EOF {
+			fmt.Fprintf(os.Stdout, "\n")
+			break
+		}
+		if err != nil && err != term.ErrPasteIndicator {
+			fmt.Fprintf(os.Stderr, "sh: %v\n", err)
+			return 1
+		}
+		sh.run(line)
+	}
+	return sh.status
+}
+
+func (sh *shell) prompt() string {
+	hostname, _ := os.Hostname()
+	wd, _ := os.Getwd()
+	if home := os.Getenv("HOME"); home != "" && home != "/" && strings.HasPrefix(wd+"/", home+"/") {
+		wd = "~" + strings.TrimPrefix(wd, home)
+	}
+	suffix := "# "
+	if os.Geteuid() != 0 {
+		suffix = "$ "
+	}
+	return hostname + ":" + wd + suffix
+}
+
+// run parses and executes line.
+func (sh *shell) run(line string) {
+	toks, err := lex(line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sh: %v\n", err)
+		sh.status = 2
+		return
+	}
+	list, err := parse(toks)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sh: %v\n", err)
+		sh.status = 2
+		return
+	}
+	for _, ao := range list {
+		if sh.exited {
+			return
+		}
+		if ao.op == "&&" && sh.status != 0 ||
+			ao.op == "||" && sh.status == 0 {
+			continue
+		}
+		sh.status = sh.runPipeline(ao.pipeline)
+	}
+}
+
+// wordPart is a part of a word with the same quoting.
+type wordPart struct {
+	text  string
+	quote byte // 0 (unquoted), '\'' or '"'
+}
+
+type word []wordPart
+
+// token is either an operator or a word.
+type token struct {
+	op   string
+	word word
+}
+
+// lex splits line into words and operators.
+func lex(line string) ([]token, error) {
+	var (
+		toks   []token
+		cur    word
+		inWord bool
+	)
+	flush := func() {
+		if inWord {
+			toks = append(toks, token{word: cur})
+		}
+		cur, inWord = nil, false
+	}
+	add := func(quote byte, s string) {
+		inWord = true
+		if n := len(cur); n > 0 && cur[n-1].quote == quote {
+			cur[n-1].text += s
+			return
+		}
+		cur = append(cur, wordPart{text: s, quote: quote})
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			flush()
+
+		case c == '#' && !inWord:
+			flush()
+			return toks, nil
+
+		case c == '\\':
+			if i+1 < len(line) {
+				i++
+				add('\'', line[i:i+1])
+			}
+
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end == -1 {
+				return nil, errors.New("unterminated quote")
+			}
+			add('\'', line[i+1:i+1+end])
+			i += end + 1
+
+		case c == '"':
+			add('"', "")
+			for i++; ; i++ {
+				if i >= len(line) {
+					return nil, errors.New("unterminated quote")
+				}
+				if line[i] == '"' {
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\\\"$", line[i+1]) != -1 {
+					i++
+					add('\'', line[i:i+1])
+					continue
+				}
+				add('"', line[i:i+1])
+			}
+
+		case strings.IndexByte("|&;<>", c) != -1:
+			fd := ""
+			if (c == '<' || c == '>') && len(cur) == 1 && cur[0].quote == 0 && isDigits(cur[0].text) {
+				fd = cur[0].text
+				cur, inWord = nil, false
+			}
+			flush()
+			op := line[i : i+1]
+			if i+1 < len(line) {
+				switch two := line[i : i+2]; two {
+				case "||", "&&", ">>", ">&":
+					op = two
+					i++
+				}
+			}
+			toks = append(toks, token{op: fd + op})
+
+		default:
+			add(0, line[i:i+1])
+		}
+	}
+	flush()
+	return toks, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// redirect is a redirection of file descriptor fd, e.g. 2>&1.
+type redirect struct {
+	fd     int
+	op     string // "<", ">", ">>" or ">&"
+	target word
+}
+
+type simpleCommand struct {
+	words  []word
+	redirs []redirect
+}
+
+type pipeline []*simpleCommand
+
+// andOr is a pipeline which is run depending on op and the exit status of
+// the previous pipeline.
+type andOr struct {
+	op       string // ";", "&&" or "||"
+	pipeline pipeline
+}
+
+// parse parses the tokens of a line into a list of pipelines.
+func parse(toks []token) ([]andOr, error) {
+	var (
+		list []andOr
+		op   = ";"
+		p    pipeline
+		cmd  = &simpleCommand{}
+	)
+	empty := func() bool { return len(cmd.words) == 0 && len(cmd.redirs) == 0 }
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if t.op == "" {
+			cmd.words = append(cmd.words, t.word)
+			continue
+		}
+		switch name := strings.TrimLeft(t.op, "0123456789"); name {
+		case "<", ">", ">>", ">&":
+			if i+1 >= len(toks) || toks[i+1].op != "" {
+				return nil, fmt.Errorf("syntax error: missing target for %s", t.op)
+			}
+			fd := 1
+			if name == "<" {
+				fd = 0
+			}
+			if n := strings.TrimSuffix(t.op, name); n != "" {
+				fd, _ = strconv.Atoi(n)
+			}
+			cmd.redirs = append(cmd.redirs, redirect{fd: fd, op: name, target: toks[i+1].word})
+			i++
+
+		case "|", "||", "&&", ";":
+			if empty() {
+				if name == ";" && len(p) == 0 && op == ";" {
+					continue // empty command, e.g. ";;" or leading ";"
+				}
+				return nil, fmt.Errorf("syntax error near unexpected %s", name)
+			}
+			p = append(p, cmd)
+			cmd = &simpleCommand{}
+			if name != "|" {
+				list = append(list, andOr{op: op, pipeline: p})
+				p = nil
+				op = name
+			}
+
+		case "&":
+			return nil, errors.New("background jobs are not supported")
+
+		default:
+			return nil, fmt.Errorf("syntax error near unexpected %s", t.op)
+		}
+	}
+	if !empty() {
+		p = append(p, cmd)
+	} else if len(p) > 0 || op != ";" {
+		return nil, errors.New("syntax error: unexpected end of line")
+	}
+	if len(p) > 0 {
+		list = append(list, andOr{op: op, pipeline: p})
+	}
+	return list, nil
+}
+
+// expandVars replaces $NAME, ${NAME}, $? and $$ in s.
+func (sh *shell) expandVars(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch rest := s[i+1:]; {
+		case rest[0] == '?':
+			b.WriteString(strconv.Itoa(sh.status))
+			i++
+		case rest[0] == '$':
+			b.WriteString(strconv.Itoa(os.Getpid()))
+			i++
+		case rest[0] == '{':
+			end := strings.IndexByte(rest, '}')
+			if end == -1 {
+				b.WriteByte('$')
+				continue
+			}
+			b.WriteString(os.Getenv(rest[1:end]))
+			i += end + 1
+		default:
+			n := 0
+			for n < len(rest) && (rest[n] == '_' || isAlnum(rest[n])) {
+				n++
+			}
+			if n == 0 {
+				b.WriteByte('$')
+				continue
+			}
+			b.WriteString(os.Getenv(rest[:n]))
+			i += n
+		}
+	}
+	return b.String()
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// expand expands variables, a leading ~ and (for unquoted parts) glob
+// patterns of w. Globs without matches are kept as-is.
+func (sh *shell) expand(w word) []string {
+	var s, pattern strings.Builder
+	glob := false
+	for i, part := range w {
+		text := part.text
+		if part.quote != '\'' {
+			text = sh.expandVars(text)
+		}
+		if i == 0 && part.quote == 0 && (text == "~" || strings.HasPrefix(text, "~/")) {
+			text = os.Getenv("HOME") + text[1:]
+		}
+		s.WriteString(text)
+		if part.quote == 0 {
+			glob = glob || strings.ContainsAny(text, "*?[")
+			pattern.WriteString(text)
+		} else {
+			for _, r := range text {
+				if strings.ContainsRune(`*?[\`, r) {
+					pattern.WriteByte('\\')
+				}
+				pattern.WriteRune(r)
+			}
+		}
+	}
+	if glob {
+		if matches, _ := filepath.Glob(pattern.String()); len(matches) > 0 {
+			return matches
+		}
+	}
+	return []string{s.String()}
+}
+
+// isAssignment reports whether w is a variable assignment like NAME=value.
+func isAssignment(w word) bool {
+	if len(w) == 0 || w[0].quote != 0 {
+		return false
+	}
+	name, _, ok := strings.Cut(w[0].text, "=")
+	if !ok || name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '_' && !isAlnum(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// runPipeline runs all commands of p concurrently and returns the exit
+// status of the last one.
+func (sh *shell) runPipeline(p pipeline) int {
+	var waits []func() int
+	stdin := os.Stdin
+	for i, c := range p {
+		stdio := [3]*os.File{stdin, os.Stdout, os.Stderr}
+		var owned []*os.File // closed once the command started
+		if i > 0 {
+			owned = append(owned, stdin)
+		}
+		if i < len(p)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "sh: %v\n", err)
+				closeFiles(owned)
+				break
+			}
+			stdio[1] = w
+			owned = append(owned, w)
+			stdin = r
+		}
+		waits = append(waits, sh.start(c, stdio, owned))
+	}
+	status := 1
+	for _, wait := range waits {
+		status = wait()
+	}
+	return status
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// start starts the simple command c and returns a function which waits for
+// it to finish and returns its exit status.
+func (sh *shell) start(c *simpleCommand, stdio [3]*os.File, owned []*os.File) func() int {
+	fail := func(status int, format string, args ...any) func() int {
+		fmt.Fprintf(stdio[2], "sh: "+format+"\n", args...)
+		closeFiles(owned)
+		return func() int { return status }
+	}
+
+	for _, r := range c.redirs {
+		if r.fd < 0 || r.fd > 2 {
+			return fail(1, "%d: bad file descriptor", r.fd)
+		}
+		target := strings.Join(sh.expand(r.target), " ")
+		if r.op == ">&" {
+			n, err := strconv.Atoi(target)
+			if err != nil || n < 0 || n > 2 {
+				return fail(1, "%s: bad file descriptor", target)
+			}
+			stdio[r.fd] = stdio[n]
+			continue
+		}
+		var f *os.File
+		var err error
+		switch r.op {
+		case "<":
+			f, err = os.Open(target)
+		case ">":
+			f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		case ">>":
+			f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		}
+		if err != nil {
+			return fail(1, "%v", err)
+		}
+		stdio[r.fd] = f
+		owned = append(owned, f)
+	}
+
+	words := c.words
+	var assigns []string
+	for len(words) > 0 && isAssignment(words[0]) {
+		assigns = append(assigns, strings.Join(sh.expand(words[0]), " "))
+		words = words[1:]
+	}
+	var args []string
+	for _, w := range words {
+		args = append(args, sh.expand(w)...)
+	}
+	if len(args) == 0 {
+		for _, a := range assigns {
+			name, val, _ := strings.Cut(a, "=")
+			os.Setenv(name, val)
+		}
+		closeFiles(owned)
+		return func() int { return 0 }
+	}
+
+	fn, ok := shellBuiltins[args[0]]
+	path, err := exec.LookPath(args[0])
+	if !ok && err != nil {
+		// Prefer programs installed by the user (e.g. from a debug
+		// tarball) over the less capable utilities of the shell.
+		fn, ok = shellUtilities[args[0]]
+	}
+	if ok {
+		done := make(chan int, 1)
+		go func() {
+			status := fn(&shellCmd{
+				sh:     sh,
+				args:   args,
+				stdin:  stdio[0],
+				stdout: stdio[1],
+				stderr: stdio[2],
+			})
+			closeFiles(owned)
+			done <- status
+		}()
+		return func() int { return <-done }
+	}
+	if err != nil {
+		return fail(127, "%s: not found", args[0])
+	}
+
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   args,
+		Stdin:  stdio[0],
+		Stdout: stdio[1],
+		Stderr: stdio[2],
+	}
+	if len(assigns) > 0 {
+		cmd.Env = append(os.Environ(), assigns...)
+	}
+	if err := cmd.Start(); err != nil {
+		return fail(126, "%v", err)
+	}
+	closeFiles(owned)
+	return func() int {
+		cmd.Wait()
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return cmd.ProcessState.ExitCode()
+	}
+}
+
+// shellCmd is a builtin command run by the shell.
+type shellCmd struct {
+	sh     *shell
+	args   []string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// errorf prints an error message and returns exit status 1.
+func (c *shellCmd) errorf(format string, args ...any) int {
+	fmt.Fprintf(c.stderr, "%s: %s\n", c.args[0], fmt.Sprintf(format, args...))
+	return 1
+}
+
+// shellBuiltins are commands implemented by the shell itself.
+var shellBuiltins map[string]func(*shellCmd) int
+
+func init() {
+	shellBuiltins = map[string]func(*shellCmd) int{
+		"cd":     shCd,
+		"echo":   shEcho,
+		"env":    shEnv,
+		"exit":   shExit,
+		"export": shExport,
+		"false":  func(*shellCmd) int { return 1 },
+		"help":   shHelp,
+		"pwd":    shPwd,
+		"true":   func(*shellCmd) int { return 0 },
+		"unset":  shUnset,
+	}
+}
+
+func shCd(c *shellCmd) int {
+	dir := os.Getenv("HOME")
+	if len(c.args) > 1 {
+		dir = c.args[1]
+	}
+	if dir == "-" {
+		dir = os.Getenv("OLDPWD")
+		fmt.Fprintln(c.stdout, dir)
+	}
+	if dir == "" {
+		dir = "/"
+	}
+	old, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		return c.errorf("%v", err)
+	}
+	wd, _ := os.Getwd()
+	os.Setenv("OLDPWD", old)
+	os.Setenv("PWD", wd)
+	return 0
+}
+
+func shEcho(c *shellCmd) int {
+	args := c.args[1:]
+	newline := true
+	if len(args) > 0 && args[0] == "-n" {
+		newline = false
+		args = args[1:]
+	}
+	fmt.Fprint(c.stdout, strings.Join(args, " "))
+	if newline {
+		fmt.Fprintln(c.stdout)
+	}
+	return 0
+}
+
+func shEnv(c *shellCmd) int {
+	for _, kv := range os.Environ() {
+		fmt.Fprintln(c.stdout, kv)
+	}
+	return 0
+}
+
+func shExit(c *shellCmd) int {
+	status := c.sh.status
+	if len(c.args) > 1 {
+		n, err := strconv.Atoi(c.args[1])
+		if err != nil {
+			return c.errorf("invalid exit status %q", c.args[1])
+		}
+		status = n
+	}
+	c.sh.exited = true
+	return status
+}
+
+func shExport(c *shellCmd) int {
+	if len(c.args) == 1 {
+		env := os.Environ()
+		sort.Strings(env)
+		for _, kv := range env {
+			name, val, _ := strings.Cut(kv, "=")
+			fmt.Fprintf(c.stdout, "export %s=%q\n", name, val)
+		}
+		return 0
+	}
+	for _, arg := range c.args[1:] {
+		// Variables are always exported, so only assignments matter.
+		if name, val, ok := strings.Cut(arg, "="); ok {
+			os.Setenv(name, val)
+		}
+	}
+	return 0
+}
+
+func shHelp(c *shellCmd) int {
+	names := func(m map[string]func(*shellCmd) int) string {
+		var result []string
+		for name := range m {
+			result = append(result, name)
+		}
+		sort.Strings(result)
+		return strings.Join(result, " ")
+	}
+	fmt.Fprintf(c.stdout, "breakglass built-in shell\n\n")
+	fmt.Fprintf(c.stdout, "Builtins: %s\n", names(shellBuiltins))
+	fmt.Fprintf(c.stdout, "Utilities (unless found in $PATH): %s\n", names(shellUtilities))
+	return 0
+}
+
+func shPwd(c *shellCmd) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	fmt.Fprintln(c.stdout, wd)
+	return 0
+}
+
+func shUnset(c *shellCmd) int {
+	for _, name := range c.args[1:] {
+		os.Unsetenv(name)
+	}
+	return 0
+}
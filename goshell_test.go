@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// formatWord formats w with the quoting of each part, e.g. a'b'"c".
+func formatWord(w word) string {
+	var b strings.Builder
+	for _, part := range w {
+		if part.quote != 0 {
+			b.WriteByte(part.quote)
+		}
+		b.WriteString(part.text)
+		if part.quote != 0 {
+			b.WriteByte(part.quote)
+		}
+	}
+	return b.String()
+}
+
+func formatTokens(toks []token) []string {
+	var result []string
+	for _, t := range toks {
+		if t.op != "" {
+			result = append(result, t.op)
+		} else {
+			result = append(result, formatWord(t.word))
+		}
+	}
+	return result
+}
+
+func TestLex(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  echo hello \t world  ", []string{"echo", "hello", "world"}},
+		{`echo 'a b' "c d"`, []string{"echo", "'a b'", `"c d"`}},
+		{`echo a'b'"c"`, []string{"echo", `a'b'"c"`}},
+		{`echo "" ''`, []string{"echo", `""`, "''"}},
+		{`echo \$HOME a\ b`, []string{"echo", "'$'HOME", "a' 'b"}},
+		{`echo "a\"b\$c\d"`, []string{"echo", `"a"'"'"b"'$'"c\d"`}},
+		{"ls # comment", []string{"ls"}},
+		{"echo a#b", []string{"echo", "a#b"}},
+		{"a|b&&c||d;e&", []string{"a", "|", "b", "&&", "c", "||", "d", ";", "e", "&"}},
+		{"cmd 2>&1 >>log <in", []string{"cmd", "2>&", "1", ">>", "log", "<", "in"}},
+		{"cmd 2>err", []string{"cmd", "2>", "err"}},
+		{"echo 2 >out", []string{"echo", "2", ">", "out"}},
+		{"echo '2'>out", []string{"echo", "'2'", ">", "out"}},
+		{"echo a2>out", []string{"echo", "a2", ">", "out"}},
+	} {
+		toks, err := lex(tt.line)
+		if err != nil {
+			t.Errorf("lex(%q): %v", tt.line, err)
+			continue
+		}
+		if got := formatTokens(toks); !slices.Equal(got, tt.want) {
+			t.Errorf("lex(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	for _, line := range []string{
+		"echo 'abc",
+		`echo "abc`,
+		`echo "abc\"`,
+	} {
+		if toks, err := lex(line); err == nil {
+			t.Errorf("lex(%q) = %q, want error", line, formatTokens(toks))
+		}
+	}
+}
+
+// formatList formats the pipelines of list, e.g. "; [a] | [b] && [c 1>out]".
+func formatList(list []andOr) string {
+	var entries []string
+	for _, ao := range list {
+		var cmds []string
+		for _, c := range ao.pipeline {
+			var fields []string
+			for _, w := range c.words {
+				fields = append(fields, formatWord(w))
+			}
+			for _, r := range c.redirs {
+				fields = append(fields, fmt.Sprintf("%d%s%s", r.fd, r.op, formatWord(r.target)))
+			}
+			cmds = append(cmds, "["+strings.Join(fields, " ")+"]")
+		}
+		entries = append(entries, ao.op+" "+strings.Join(cmds, " | "))
+	}
+	return strings.Join(entries, " ")
+}
+
+func lexAndParse(line string) ([]andOr, error) {
+	toks, err := lex(line)
+	if err != nil {
+		return nil, err
+	}
+	return parse(toks)
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want string
+	}{
+		{"", ""},
+		{"# comment", ""},
+		{"echo hi", "; [echo hi]"},
+		{"a | b && c || d ; e", "; [a] | [b] && [c] || [d] ; [e]"},
+		{"a | b | c", "; [a] | [b] | [c]"},
+		{"cat <in >out 2>>err", "; [cat 0<in 1>out 2>>err]"},
+		{"cmd 2>&1", "; [cmd 2>&1]"},
+		{"cmd >&2", "; [cmd 1>&2]"},
+		{">out", "; [1>out]"},
+		{";; a;", "; [a]"},
+		{"a; ;b", "; [a] ; [b]"},
+	} {
+		list, err := lexAndParse(tt.line)
+		if err != nil {
+			t.Errorf("parse(%q): %v", tt.line, err)
+			continue
+		}
+		if got := formatList(list); got != tt.want {
+			t.Errorf("parse(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, line := range []string{
+		"| a",
+		"a |",
+		"a &&",
+		"a && && b",
+		"a ; | b",
+		"a || ; b",
+		"a >",
+		"a > | b",
+		"a 2>&",
+		"sleep 1 &",
+	} {
+		if list, err := lexAndParse(line); err == nil {
+			t.Errorf("parse(%q) = %q, want error", line, formatList(list))
+		}
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	t.Setenv("BG_TEST", "x")
+	os.Unsetenv("BG_TESTy")
+	sh := &shell{status: 3}
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"plain", "plain"},
+		{"$BG_TEST", "x"},
+		{"a${BG_TEST}y", "axy"},
+		{"$BG_TESTy", ""},
+		{"$BG_TEST-y", "x-y"},
+		{"$?", "3"},
+		{"a$", "a$"},
+		{"$-", "$-"},
+		{"${BG_TEST", "${BG_TEST"},
+	} {
+		if got := sh.expandVars(tt.in); got != tt.want {
+			t.Errorf("expandVars(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "*.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+	t.Setenv("HOME", "/home/alice")
+	t.Setenv("BG_TEST", "a b")
+	sh := &shell{}
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{"[ab].txt", []string{"a.txt", "b.txt"}},
+		{"'*'.txt", []string{"*.txt"}},
+		{`"["ab].txt`, []string{"[ab].txt"}},
+		{"*.none", []string{"*.none"}},
+		{`"$BG_TEST"`, []string{"a b"}},
+		{"'$BG_TEST'", []string{"$BG_TEST"}},
+		{"~/x", []string{"/home/alice/x"}},
+		{"'~'/x", []string{"~/x"}},
+		{"a~", []string{"a~"}},
+	} {
+		toks, err := lex(tt.in)
+		if err != nil || len(toks) != 1 {
+			t.Fatalf("lex(%q) = %q, %v", tt.in, formatTokens(toks), err)
+		}
+		if got := sh.expand(toks[0].word); !slices.Equal(got, tt.want) {
+			t.Errorf("expand(%s) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIsAssignment(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want bool
+	}{
+		{"A=b", true},
+		{"_x=", true},
+		{`A="b c"`, true},
+		{"A", false},
+		{"=b", false},
+		{"1A=b", false},
+		{"A-B=c", false},
+		{"'A=b'", false},
+		{`"A"=b`, false},
+	} {
+		toks, err := lex(tt.in)
+		if err != nil || len(toks) != 1 {
+			t.Fatalf("lex(%q) = %q, %v", tt.in, formatTokens(toks), err)
+		}
+		if got := isAssignment(toks[0].word); got != tt.want {
+			t.Errorf("isAssignment(%s) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"golang.org/x/sys/unix"
+)
+
+// shellUtilities are minimal implementations of the most important
+// commands for debugging, used by the built-in shell unless a program of the
+// same name is found in $PATH.
+var shellUtilities = map[string]func(*shellCmd) int{
+	"cat":    shCat,
+	"df":     shDf,
+	"dmesg":  shDmesg,
+	"free":   shFree,
+	"ip":     shIP,
+	"kill":   shKill,
+	"ls":     shLs,
+	"mkdir":  shMkdir,
+	"mount":  shMount,
+	"ps":     shPs,
+	"rm":     shRm,
+	"umount": shUmount,
+}
+
+// flags splits args into single-letter flags (e.g. -la) and operands. It
+// returns an error for flags which are not in allowed.
+func flags(args []string, allowed string) (map[rune]bool, []string, error) {
+	set := make(map[rune]bool)
+	var operands []string
+	for i, arg := range args {
+		if arg == "--" {
+			operands = append(operands, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			operands = append(operands, arg)
+			continue
+		}
+		for _, f := range arg[1:] {
+			if !strings.ContainsRune(allowed, f) {
+				return nil, nil, fmt.Errorf("unknown flag -%c", f)
+			}
+			set[f] = true
+		}
+	}
+	return set, operands, nil
+}
+
+func shCat(c *shellCmd) int {
+	files := c.args[1:]
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	status := 0
+	for _, fn := range files {
+		if fn == "-" {
+			io.Copy(c.stdout, c.stdin)
+			continue
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			status = c.errorf("%v", err)
+			continue
+		}
+		if _, err := io.Copy(c.stdout, f); err != nil {
+			status = c.errorf("%v", err)
+		}
+		f.Close()
+	}
+	return status
+}
+
+// lsMode formats the file mode like ls(1) does, e.g. drwxr-xr-x.
+func lsMode(mode fs.FileMode) string {
+	typ := "-"
+	switch {
+	case mode&fs.ModeDir != 0:
+		typ = "d"
+	case mode&fs.ModeSymlink != 0:
+		typ = "l"
+	case mode&fs.ModeCharDevice != 0:
+		typ = "c"
+	case mode&fs.ModeDevice != 0:
+		typ = "b"
+	case mode&fs.ModeNamedPipe != 0:
+		typ = "p"
+	case mode&fs.ModeSocket != 0:
+		typ = "s"
+	}
+	return typ + mode.Perm().String()[1:]
+}
+
+func shLs(c *shellCmd) int {
+	set, paths, err := flags(c.args[1:], "la1")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	entry := func(path, name string, fi fs.FileInfo) {
+		if !set['l'] {
+			fmt.Fprintln(c.stdout, name)
+			return
+		}
+		var nlink uint64
+		var uid, gid uint32
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			nlink, uid, gid = uint64(st.Nlink), st.Uid, st.Gid
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if target, err := os.Readlink(path); err == nil {
+				name += " -> " + target
+			}
+		}
+		fmt.Fprintf(c.stdout, "%s %3d %5d %5d %10d %s %s\n",
+			lsMode(fi.Mode()), nlink, uid, gid, fi.Size(), fi.ModTime().Format("Jan _2 15:04"), name)
+	}
+	status := 0
+	for i, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			status = c.errorf("%v", err)
+			continue
+		}
+		if !fi.IsDir() {
+			entry(path, path, fi)
+			continue
+		}
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Fprintln(c.stdout)
+			}
+			fmt.Fprintf(c.stdout, "%s:\n", path)
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			status = c.errorf("%v", err)
+		}
+		for _, e := range entries {
+			if !set['a'] && strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue // removed in the meantime
+			}
+			entry(filepath.Join(path, e.Name()), e.Name(), info)
+		}
+	}
+	return status
+}
+
+func shMkdir(c *shellCmd) int {
+	set, dirs, err := flags(c.args[1:], "p")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	status := 0
+	for _, dir := range dirs {
+		if set['p'] {
+			err = os.MkdirAll(dir, 0777)
+		} else {
+			err = os.Mkdir(dir, 0777)
+		}
+		if err != nil {
+			status = c.errorf("%v", err)
+		}
+	}
+	return status
+}
+
+func shRm(c *shellCmd) int {
+	set, paths, err := flags(c.args[1:], "rf")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	status := 0
+	for _, path := range paths {
+		if set['r'] {
+			err = os.RemoveAll(path)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil && !(set['f'] && os.IsNotExist(err)) {
+			status = c.errorf("%v", err)
+		}
+	}
+	return status
+}
+
+func shPs(c *shellCmd) int {
+	dirents, err := os.ReadDir("/proc")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	var pids []int
+	for _, d := range dirents {
+		if pid, err := strconv.Atoi(d.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "PID\tPPID\tUID\tSTAT\tRSS\t COMMAND\n")
+	for _, pid := range pids {
+		dir := fmt.Sprintf("/proc/%d", pid)
+		b, err := os.ReadFile(dir + "/stat")
+		if err != nil {
+			continue // exited in the meantime
+		}
+		// The command name may contain spaces and parentheses.
+		stat := string(b)
+		open, close := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+		if open == -1 || close < open {
+			continue
+		}
+		comm := stat[open+1 : close]
+		fields := strings.Fields(stat[close+1:])
+		if len(fields) < 22 {
+			continue
+		}
+		state, ppid := fields[0], fields[1]
+		rss, _ := strconv.Atoi(fields[21])
+		command := comm
+		if cmdline, err := os.ReadFile(dir + "/cmdline"); err == nil && len(cmdline) > 0 {
+			command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		} else {
+			command = "[" + comm + "]"
+		}
+		var uid uint32
+		if fi, err := os.Stat(dir); err == nil {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				uid = st.Uid
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%d\t %s\n", pid, ppid, uid, state, rss*os.Getpagesize()/1024, command)
+	}
+	tw.Flush()
+	return 0
+}
+
+// mountFlags maps mount options to mount(2) flags.
+var mountFlags = map[string]uintptr{
+	"ro":       unix.MS_RDONLY,
+	"nosuid":   unix.MS_NOSUID,
+	"nodev":    unix.MS_NODEV,
+	"noexec":   unix.MS_NOEXEC,
+	"sync":     unix.MS_SYNCHRONOUS,
+	"remount":  unix.MS_REMOUNT,
+	"bind":     unix.MS_BIND,
+	"rbind":    unix.MS_BIND | unix.MS_REC,
+	"noatime":  unix.MS_NOATIME,
+	"relatime": unix.MS_RELATIME,
+}
+
+func shMount(c *shellCmd) int {
+	args := c.args[1:]
+	if len(args) == 0 {
+		b, err := os.ReadFile("/proc/mounts")
+		if err != nil {
+			return c.errorf("%v", err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 4 {
+				continue
+			}
+			fmt.Fprintf(c.stdout, "%s on %s type %s (%s)\n", f[0], f[1], f[2], f[3])
+		}
+		return 0
+	}
+	const syntax = "syntax: mount [-t type] [-o options] [source] target"
+	var fstype, options string
+	var operands []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-t", "-o":
+			if i+1 >= len(args) {
+				return c.errorf(syntax)
+			}
+			if args[i] == "-t" {
+				fstype = args[i+1]
+			} else {
+				options = args[i+1]
+			}
+			i++
+		default:
+			operands = append(operands, args[i])
+		}
+	}
+	var flags uintptr
+	var data []string
+	for _, opt := range strings.Split(options, ",") {
+		if f, ok := mountFlags[opt]; ok {
+			flags |= f
+		} else if opt != "" && opt != "rw" && opt != "defaults" {
+			data = append(data, opt)
+		}
+	}
+	var source, target string
+	switch {
+	case len(operands) == 2:
+		source, target = operands[0], operands[1]
+	case len(operands) == 1 && flags&unix.MS_REMOUNT != 0:
+		target = operands[0]
+	default:
+		return c.errorf(syntax)
+	}
+	if err := unix.Mount(source, target, fstype, flags, strings.Join(data, ",")); err != nil {
+		return c.errorf("%v", err)
+	}
+	return 0
+}
+
+func shUmount(c *shellCmd) int {
+	set, targets, err := flags(c.args[1:], "l")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	var flags int
+	if set['l'] {
+		flags = unix.MNT_DETACH
+	}
+	status := 0
+	for _, target := range targets {
+		if err := unix.Unmount(target, flags); err != nil {
+			status = c.errorf("%s: %v", target, err)
+		}
+	}
+	return status
+}
+
+func shDmesg(c *shellCmd) int {
+	size, err := unix.Klogctl(unix.SYSLOG_ACTION_SIZE_BUFFER, nil)
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	buf := make([]byte, size)
+	n, err := unix.Klogctl(unix.SYSLOG_ACTION_READ_ALL, buf)
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	s := bufio.NewScanner(strings.NewReader(string(buf[:n])))
+	for s.Scan() {
+		line := s.Text()
+		// Strip the log level, e.g. <6>.
+		if strings.HasPrefix(line, "<") {
+			if idx := strings.IndexByte(line, '>'); idx != -1 && idx < 5 {
+				line = line[idx+1:]
+			}
+		}
+		fmt.Fprintln(c.stdout, line)
+	}
+	return 0
+}
+
+func shIP(c *shellCmd) int {
+	const syntax = "syntax: ip addr|link [show [dev] <interface>]"
+	if len(c.args) < 2 {
+		return c.errorf(syntax)
+	}
+	var addrs bool
+	switch c.args[1] {
+	case "a", "addr", "address":
+		addrs = true
+	case "l", "link":
+	default:
+		return c.errorf(syntax)
+	}
+	var name string
+	for _, arg := range c.args[2:] {
+		if arg != "show" && arg != "list" && arg != "dev" {
+			name = arg
+		}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	found := false
+	for _, ifi := range ifaces {
+		if name != "" && ifi.Name != name {
+			continue
+		}
+		found = true
+		flags := strings.ToUpper(strings.ReplaceAll(ifi.Flags.String(), "|", ","))
+		fmt.Fprintf(c.stdout, "%d: %s: <%s> mtu %d\n", ifi.Index, ifi.Name, flags, ifi.MTU)
+		if len(ifi.HardwareAddr) > 0 {
+			fmt.Fprintf(c.stdout, "    link/ether %s\n", ifi.HardwareAddr)
+		}
+		if !addrs {
+			continue
+		}
+		ifaddrs, err := ifi.Addrs()
+		if err != nil {
+			c.errorf("%s: %v", ifi.Name, err)
+			continue
+		}
+		for _, a := range ifaddrs {
+			family := "inet"
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() == nil {
+				family = "inet6"
+			}
+			fmt.Fprintf(c.stdout, "    %s %s\n", family, a)
+		}
+	}
+	if name != "" && !found {
+		return c.errorf("device %q does not exist", name)
+	}
+	return 0
+}
+
+// parseSignal parses a signal number or name like 9, KILL or SIGKILL.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+func shKill(c *shellCmd) int {
+	const syntax = "syntax: kill [-l] [-SIGNAL|-s SIGNAL] <pid>…"
+	args := c.args[1:]
+	if len(args) > 0 && args[0] == "-l" {
+		for sig := syscall.Signal(1); sig < 32; sig++ {
+			fmt.Fprintf(c.stdout, "%2d %s\n", sig, strings.TrimPrefix(unix.SignalName(sig), "SIG"))
+		}
+		return 0
+	}
+	sig := syscall.SIGTERM
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "--" {
+		name := args[0][1:]
+		args = args[1:]
+		if name == "s" {
+			if len(args) == 0 {
+				return c.errorf(syntax)
+			}
+			name, args = args[0], args[1:]
+		}
+		var err error
+		if sig, err = parseSignal(name); err != nil {
+			return c.errorf("%v", err)
+		}
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return c.errorf(syntax)
+	}
+	status := 0
+	for _, arg := range args {
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			status = c.errorf("invalid pid %q", arg)
+			continue
+		}
+		if err := syscall.Kill(pid, sig); err != nil {
+			status = c.errorf("%d: %v", pid, err)
+		}
+	}
+	return status
+}
+
+// humanBytes formats b like df -h and free -h do, e.g. 1.5G.
+func humanBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return strconv.FormatUint(b, 10)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func shDf(c *shellCmd) int {
+	set, _, err := flags(c.args[1:], "h")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	format := func(b uint64) string {
+		if set['h'] {
+			return humanBytes(b)
+		}
+		return strconv.FormatUint(b/1024, 10)
+	}
+	b, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 1, ' ', 0)
+	if set['h'] {
+		fmt.Fprintf(tw, "Filesystem\tSize\tUsed\tAvailable\tUse%%\tMounted on\n")
+	} else {
+		fmt.Fprintf(tw, "Filesystem\t1K-blocks\tUsed\tAvailable\tUse%%\tMounted on\n")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		var st unix.Statfs_t
+		if err := unix.Statfs(f[1], &st); err != nil || st.Blocks == 0 {
+			continue // pseudo file systems like proc
+		}
+		bsize := uint64(st.Bsize)
+		total := st.Blocks * bsize
+		avail := st.Bavail * bsize
+		used := (st.Blocks - st.Bfree) * bsize
+		pct := uint64(0)
+		if used+avail > 0 {
+			pct = (used*100 + used + avail - 1) / (used + avail)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d%%\t%s\n", f[0], format(total), format(used), format(avail), pct, f[1])
+	}
+	tw.Flush()
+	return 0
+}
+
+func shFree(c *shellCmd) int {
+	set, _, err := flags(c.args[1:], "h")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	b, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return c.errorf("%v", err)
+	}
+	info := make(map[string]uint64) // in bytes
+	for _, line := range strings.Split(string(b), "\n") {
+		name, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		f := strings.Fields(val)
+		if len(f) == 0 {
+			continue
+		}
+		n, _ := strconv.ParseUint(f[0], 10, 64)
+		info[name] = n * 1024
+	}
+	format := func(b uint64) string {
+		if set['h'] {
+			return humanBytes(b)
+		}
+		return strconv.FormatUint(b/1024, 10)
+	}
+	total, free := info["MemTotal"], info["MemFree"]
+	buffCache := info["Buffers"] + info["Cached"] + info["SReclaimable"]
+	used := total - free - buffCache
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "\ttotal\tused\tfree\tshared\tbuff/cache\tavailable\t\n")
+	fmt.Fprintf(tw, "Mem:\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+		format(total), format(used), format(free), format(info["Shmem"]), format(buffCache), format(info["MemAvailable"]))
+	fmt.Fprintf(tw, "Swap:\t%s\t%s\t%s\t\t\t\t\n",
+		format(info["SwapTotal"]), format(info["SwapTotal"]-info["SwapFree"]), format(info["SwapFree"]))
+	tw.Flush()
+	return 0
+}
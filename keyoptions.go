@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keyOptions are the restrictions which apply to a connection that was
+// authenticated with a specific key, as specified by the options field of
+// authorized_keys(5).
+type keyOptions struct {
+	// command is run instead of any command the client requests.
+	command string
+
+	// from restricts the remote addresses from which the key may be used.
+	from []string
+
+	// expiryTime is the time after which the key is no longer accepted.
+	expiryTime time.Time
+
+	noPTY             bool
+	noPortForwarding  bool
+	noAgentForwarding bool
+
+	// strictExec runs commands without a shell (see -strict_exec).
+	strictExec bool
+
+	// permitOpen restricts local port forwarding (ssh -L) to the specified
+	// host:port destinations, like in OpenSSH.
+	permitOpen []string
+
+	// forwardPolicy restricts local port forwarding with the rules of
+	// the -forward flag (breakglass-specific forward-policy option).
+	forwardPolicy forwardPolicy
+
+	// credential, if non-nil, is the unprivileged user as which commands
+	// are run (see -users). It is not an authorized_keys option.
+	credential *syscall.Credential
+}
+
+// keyOptionsKey is the key under which *keyOptions are stored in
+// ssh.Permissions.ExtraData.
+type keyOptionsKey struct{}
+
+// connOptions returns the keyOptions which the PublicKeyCallback stored for
+// the connection.
+func connOptions(perms *ssh.Permissions) *keyOptions {
+	if perms != nil {
+		if opts, ok := perms.ExtraData[keyOptionsKey{}].(*keyOptions); ok {
+			return opts
+		}
+	}
+	return &keyOptions{}
+}
+
+// permissions returns ssh.Permissions which carry opts to the session and
+// channel handlers.
+func (o *keyOptions) permissions() *ssh.Permissions {
+	return &ssh.Permissions{
+		ExtraData: map[any]any{keyOptionsKey{}: o},
+	}
+}
+
+// unquoteOption returns the value of an option such as command="echo hi",
+// with the surrounding double quotes removed and \" unescaped.
+func unquoteOption(val string) (string, error) {
+	if len(val) < 2 || val[0] != '"' || val[len(val)-1] != '"' {
+		return "", fmt.Errorf("value %s is not enclosed in double quotes", val)
+	}
+	return strings.ReplaceAll(val[1:len(val)-1], `\"`, `"`), nil
+}
+
+// parseExpiryTime parses a timestamp in the YYYYMMDD[HHMM[SS]][Z] format
+// used by the expiry-time option. Timestamps without a trailing Z are
+// interpreted in the local time zone.
+func parseExpiryTime(val string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(val, "Z") {
+		loc = time.UTC
+		val = strings.TrimSuffix(val, "Z")
+	}
+	var layout string
+	switch len(val) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q: want YYYYMMDD[HHMM[SS]]", val)
+	}
+	return time.ParseInLocation(layout, val, loc)
+}
+
+// parseKeyOptions parses the options field of an authorized_keys(5) line, as
+// returned by ssh.ParseAuthorizedKey. Unknown options result in an error so
+// that a key is never accepted with fewer restrictions than intended.
+func parseKeyOptions(options []string) (*keyOptions, error) {
+	opts := &keyOptions{}
+	for _, option := range options {
+		name, val, hasVal := strings.Cut(option, "=")
+		if hasVal {
+			var err error
+			val, err = unquoteOption(val)
+			if err != nil {
+				return nil, fmt.Errorf("option %s: %v", name, err)
+			}
+		}
+		switch strings.ToLower(name) {
+		case "command":
+			opts.command = val
+
+		case "from":
+			opts.from = strings.Split(val, ",")
+
+		case "expiry-time":
+			t, err := parseExpiryTime(val)
+			if err != nil {
+				return nil, err
+			}
+			opts.expiryTime = t
+
+		case "no-pty":
+			opts.noPTY = true
+
+		case "pty":
+			opts.noPTY = false
+
+		case "no-port-forwarding":
+			opts.noPortForwarding = true
+
+		case "port-forwarding":
+			opts.noPortForwarding = false
+
+		case "permitopen":
+			if err := checkPermitOpen(val); err != nil {
+				return nil, fmt.Errorf("option permitopen: %v", err)
+			}
+			opts.permitOpen = append(opts.permitOpen, val)
+
+		case "forward-policy":
+			p, err := parseForwardPolicy(val)
+			if err != nil {
+				return nil, fmt.Errorf("option forward-policy: %v", err)
+			}
+			opts.forwardPolicy = append(opts.forwardPolicy, p...)
+
+		case "no-agent-forwarding":
+			opts.noAgentForwarding = true
+
+		case "agent-forwarding":
+			opts.noAgentForwarding = false
+
+		case "strict-exec":
+			opts.strictExec = true
+
+		case "restrict":
+			opts.noPTY = true
+			opts.noPortForwarding = true
+			opts.noAgentForwarding = true
+
+		case "no-x11-forwarding", "x11-forwarding",
+			"no-user-rc", "user-rc":
+			// breakglass implements neither of these features, so
+			// these options do not restrict anything.
+
+		default:
+			return nil, fmt.Errorf("unsupported option %q", name)
+		}
+	}
+	return opts, nil
+}
+
+// matchFrom reports whether the remote address matches the pattern list of
+// the from option. Patterns are matched against the IP address (hostnames
+// are not resolved) and may be negated with a leading !, contain * and ?
+// wildcards, or be written in CIDR notation.
+func (o *keyOptions) matchFrom(remote net.Addr) bool {
+	if len(o.from) == 0 {
+		return true
+	}
+	host := remote.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	matched := false
+	for _, pattern := range o.from {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		var match bool
+		if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+			match = ip != nil && ipnet.Contains(ip)
+		} else {
+			match, _ = path.Match(pattern, host)
+		}
+		if match && negated {
+			return false
+		}
+		if match {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// check returns an error if the key must not be used for the connection
+// described by conn.
+func (o *keyOptions) check(conn ssh.ConnMetadata) error {
+	if !o.expiryTime.IsZero() && time.Now().After(o.expiryTime) {
+		return fmt.Errorf("key expired at %v", o.expiryTime)
+	}
+	if !o.matchFrom(conn.RemoteAddr()) {
+		return fmt.Errorf("key not permitted from remote addr %s", conn.RemoteAddr())
+	}
+	return nil
+}
+
+// checkPermitOpen validates a permitopen entry, which is host:port as in
+// OpenSSH, where port may be * for any port.
+func checkPermitOpen(entry string) error {
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("%q: missing host", entry)
+	}
+	if strings.HasPrefix(host, "!") {
+		// OpenSSH would compare the host literally, which is
+		// certainly not what was intended.
+		return fmt.Errorf("%q: negation is only supported by forward-policy", entry)
+	}
+	if port == "*" {
+		return nil
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("%q: invalid port", entry)
+	}
+	return nil
+}
+
+// permitsOpen reports whether a direct-tcpip channel to host:port may be
+// opened. host is the address requested by the client, ip the address it
+// resolved to (see forwardRule.matches). As in OpenSSH, host is compared
+// literally with the permitopen entries, i.e. without resolving hostnames.
+func (o *keyOptions) permitsOpen(host string, ip net.IP, port uint32) bool {
+	if o.noPortForwarding {
+		return false
+	}
+	if len(o.permitOpen) > 0 && !o.matchPermitOpen(host, port) {
+		return false
+	}
+	if len(o.forwardPolicy) > 0 && !o.forwardPolicy.allows(host, ip, port) {
+		return false
+	}
+	return true
+}
+
+func (o *keyOptions) matchPermitOpen(host string, port uint32) bool {
+	for _, entry := range o.permitOpen {
+		h, p, _ := net.SplitHostPort(entry)
+		if h != "*" && !strings.EqualFold(h, host) {
+			continue
+		}
+		if p != "*" && p != strconv.Itoa(int(port)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
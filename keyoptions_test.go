@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseKeyOptions(t *testing.T) {
+	for _, tt := range []struct {
+		options []string
+		check   func(*keyOptions) bool
+	}{
+		{
+			options: nil,
+			check: func(o *keyOptions) bool {
+				return o.command == "" && !o.noPTY && !o.noPortForwarding
+			},
+		},
+		{
+			options: []string{`command="echo \"hi\""`},
+			check:   func(o *keyOptions) bool { return o.command == `echo "hi"` },
+		},
+		{
+			options: []string{`from="10.0.0.0/8,!10.0.0.1"`},
+			check: func(o *keyOptions) bool {
+				return len(o.from) == 2 && o.from[0] == "10.0.0.0/8" && o.from[1] == "!10.0.0.1"
+			},
+		},
+		{
+			options: []string{`expiry-time="20300102Z"`},
+			check: func(o *keyOptions) bool {
+				return o.expiryTime.Equal(time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC))
+			},
+		},
+		{
+			options: []string{"restrict"},
+			check: func(o *keyOptions) bool {
+				return o.noPTY && o.noPortForwarding
+			},
+		},
+		{
+			options: []string{"restrict", "pty"},
+			check: func(o *keyOptions) bool {
+				return !o.noPTY && o.noPortForwarding
+			},
+		},
+		{
+			options: []string{"No-Pty", "no-x11-forwarding"},
+			check:   func(o *keyOptions) bool { return o.noPTY },
+		},
+		{
+			options: []string{`permitopen="127.0.0.1:8080"`},
+			check:   func(o *keyOptions) bool { return len(o.permitOpen) == 1 },
+		},
+		{
+			options: []string{"no-agent-forwarding"},
+			check:   func(o *keyOptions) bool { return o.noAgentForwarding && !o.noPTY },
+		},
+		{
+			options: []string{"restrict", "agent-forwarding"},
+			check: func(o *keyOptions) bool {
+				return !o.noAgentForwarding && o.noPTY && o.noPortForwarding
+			},
+		},
+		{
+			options: []string{"pty", "restrict"},
+			check:   func(o *keyOptions) bool { return o.noAgentForwarding },
+		},
+		{
+			options: []string{"strict-exec"},
+			check:   func(o *keyOptions) bool { return o.strictExec },
+		},
+		{
+			options: []string{"restrict"},
+			check:   func(o *keyOptions) bool { return !o.strictExec },
+		},
+	} {
+		opts, err := parseKeyOptions(tt.options)
+		if err != nil {
+			t.Errorf("parseKeyOptions(%q): %v", tt.options, err)
+			continue
+		}
+		if !tt.check(opts) {
+			t.Errorf("parseKeyOptions(%q) = %+v, unexpected result", tt.options, opts)
+		}
+	}
+}
+
+func TestParseKeyOptionsErrors(t *testing.T) {
+	for _, options := range [][]string{
+		{"unknown-option"},
+		{"command=unquoted"},
+		{`expiry-time="2030"`},
+		{`permitopen="127.0.0.1:notaport"`},
+		// permitopen only accepts host:port, like in OpenSSH.
+		{`permitopen="127.0.0.1"`},
+		{`permitopen="loopback"`},
+		{`permitopen="!10.0.0.1:22"`},
+		{`permitopen="127.0.0.1:8000-8100"`},
+		{`permitopen=":8080"`},
+		{`forward-policy="10.0.0.0/33"`},
+	} {
+		if _, err := parseKeyOptions(options); err == nil {
+			t.Errorf("parseKeyOptions(%q) unexpectedly succeeded", options)
+		}
+	}
+}
+
+func TestMatchFrom(t *testing.T) {
+	for _, tt := range []struct {
+		from   []string
+		remote string
+		want   bool
+	}{
+		{nil, "192.0.2.1:22", true},
+		{[]string{"192.0.2.1"}, "192.0.2.1:22", true},
+		{[]string{"192.0.2.1"}, "192.0.2.2:22", false},
+		{[]string{"192.0.2.*"}, "192.0.2.2:22", true},
+		{[]string{"192.0.2.0/24"}, "192.0.2.2:22", true},
+		{[]string{"192.0.2.0/24", "!192.0.2.2"}, "192.0.2.2:22", false},
+		{[]string{"!192.0.2.2", "192.0.2.0/24"}, "192.0.2.3:22", true},
+		{[]string{"2001:db8::/32"}, "[2001:db8::1]:22", true},
+	} {
+		o := &keyOptions{from: tt.from}
+		addr, err := net.ResolveTCPAddr("tcp", tt.remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := o.matchFrom(addr); got != tt.want {
+			t.Errorf("matchFrom(%q, %s) = %v, want %v", tt.from, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestPermitsOpen(t *testing.T) {
+	for _, tt := range []struct {
+		options []string
+		host    string
+		ip      string
+		port    uint32
+		want    bool
+	}{
+		{nil, "example.com", "192.0.2.1", 80, true},
+		{[]string{"no-port-forwarding"}, "localhost", "127.0.0.1", 80, false},
+
+		// permitopen compares the host literally.
+		{[]string{`permitopen="localhost:8080"`}, "localhost", "127.0.0.1", 8080, true},
+		{[]string{`permitopen="localhost:8080"`}, "LOCALHOST", "127.0.0.1", 8080, true},
+		{[]string{`permitopen="localhost:8080"`}, "127.0.0.1", "127.0.0.1", 8080, false},
+		{[]string{`permitopen="localhost:8080"`}, "localhost", "127.0.0.1", 8081, false},
+		{[]string{`permitopen="localhost:*"`}, "localhost", "127.0.0.1", 8081, true},
+		{[]string{`permitopen="[::1]:22"`}, "::1", "::1", 22, true},
+		{[]string{`permitopen="a:1"`, `permitopen="b:2"`}, "b", "192.0.2.2", 2, true},
+
+		// forward-policy uses the rules of -forward.
+		{[]string{`forward-policy="loopback"`}, "localhost", "127.0.0.1", 8080, true},
+		{[]string{`forward-policy="loopback"`}, "10.0.0.1", "10.0.0.1", 8080, false},
+		{[]string{`forward-policy="!127.0.0.1:22,loopback"`}, "localhost", "127.0.0.1", 22, false},
+
+		// Both restrictions apply.
+		{[]string{`permitopen="localhost:*"`, `forward-policy="*:22"`}, "localhost", "127.0.0.1", 22, true},
+		{[]string{`permitopen="localhost:*"`, `forward-policy="*:22"`}, "localhost", "127.0.0.1", 80, false},
+	} {
+		opts, err := parseKeyOptions(tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := opts.permitsOpen(tt.host, net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("%q: permitsOpen(%q, %s, %d) = %v, want %v", tt.options, tt.host, tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
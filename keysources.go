@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A keySource provides authorized keys in authorized_keys(5) format.
+type keySource interface {
+	// load returns the keys, one per line.
+	load() ([]byte, error)
+}
+
+// keySourceFunc adapts a function to the keySource interface.
+type keySourceFunc func() ([]byte, error)
+
+func (f keySourceFunc) load() ([]byte, error) { return f() }
+
+// keySources maps URL schemes to constructors of key sources. Sources
+// without a location (e.g. “ec2”) are also accepted as bare words.
+var keySources = map[string]func(u *url.URL) (keySource, error){
+	"file":      newFileKeySource,
+	"http":      newHTTPKeySource,
+	"https":     newHTTPKeySource,
+	"ec2":       newEC2KeySource,
+	"gce":       newGCEKeySource,
+	"openstack": newOpenStackKeySource,
+}
+
+// keySourceSpec is one entry of the -authorized_keys flag.
+type keySourceSpec struct {
+	name    string // the entry without the refresh suffix
+	source  keySource
+	refresh time.Duration // 0 means: only on startup and SIGHUP
+}
+
+// parseKeySources parses a comma-separated list of key sources, each of
+// which is either a path or a URL, optionally followed by #refresh=<duration>:
+//
+//	/perm/breakglass.authorized_keys
+//	file:///perm/breakglass.authorized_keys.d
+//	https://github.com/stapelberg.keys#refresh=1h
+//	ec2
+//
+// File sources default to fileRefresh, all other sources are only loaded on
+// startup and SIGHUP unless a refresh interval is specified.
+func parseKeySources(specs string, fileRefresh time.Duration) ([]*keySourceSpec, error) {
+	var result []*keySourceSpec
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		ks := &keySourceSpec{name: spec}
+		refresh := ""
+		if idx := strings.LastIndex(spec, "#refresh="); idx > -1 {
+			ks.name, refresh = spec[:idx], spec[idx+len("#refresh="):]
+		}
+		u, err := url.Parse(ks.name)
+		if err != nil || u.Scheme == "" {
+			// Not a URL, but a path (or a bare scheme such as “ec2”).
+			u = &url.URL{Scheme: "file", Path: ks.name}
+			if _, ok := keySources[ks.name]; ok {
+				u = &url.URL{Scheme: ks.name}
+			}
+		}
+		newSource, ok := keySources[u.Scheme]
+		if !ok {
+			return nil, fmt.Errorf("key source %q: unknown scheme %q", spec, u.Scheme)
+		}
+		if ks.source, err = newSource(u); err != nil {
+			return nil, fmt.Errorf("key source %q: %v", spec, err)
+		}
+		if u.Scheme == "file" {
+			ks.refresh = fileRefresh
+		}
+		if refresh != "" {
+			if ks.refresh, err = time.ParseDuration(refresh); err != nil {
+				return nil, fmt.Errorf("key source %q: %v", spec, err)
+			}
+		}
+		result = append(result, ks)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no key sources specified")
+	}
+	return result, nil
+}
+
+// newFileKeySource returns a key source for an authorized_keys file or for a
+// directory containing *.pub files.
+func newFileKeySource(u *url.URL) (keySource, error) {
+	path := u.Path
+	if path == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+	return keySourceFunc(func() ([]byte, error) {
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			return os.ReadFile(path)
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.pub"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		var buf bytes.Buffer
+		for _, match := range matches {
+			b, err := os.ReadFile(match)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(bytes.TrimSpace(b))
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), nil
+	}), nil
+}
+
+// keySourceClient is used for fetching keys via HTTP(S).
+var keySourceClient = &http.Client{Timeout: 10 * time.Second}
+
+// maxKeySourceSize limits the size of keys fetched via HTTP(S), so that a
+// misbehaving server cannot exhaust the memory of the device.
+const maxKeySourceSize = 1 << 20
+
+// newHTTPKeySource returns a key source which fetches keys from a URL, for
+// example https://github.com/<user>.keys.
+func newHTTPKeySource(u *url.URL) (keySource, error) {
+	target := u.String()
+	return keySourceFunc(func() ([]byte, error) {
+		res, err := keySourceClient.Get(target)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: unexpected HTTP status %v", target, res.Status)
+		}
+		b, err := io.ReadAll(io.LimitReader(res.Body, maxKeySourceSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxKeySourceSize {
+			return nil, fmt.Errorf("%s: response exceeds %d bytes", target, maxKeySourceSize)
+		}
+		return b, nil
+	}), nil
+}
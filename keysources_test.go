@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPKeySource(t *testing.T) {
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE9Wz1ZyIbxNCBafKgLkTNOqrTfqfxQV9FJHDQ0zRIUu alice\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/alice.keys":
+			w.Write([]byte(key))
+		case "/huge.keys":
+			w.Write([]byte(strings.Repeat(key, maxKeySourceSize/len(key)+1)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"/alice.keys", key, false},
+		{"/huge.keys", "", true},
+		{"/missing.keys", "", true},
+	} {
+		u, err := url.Parse(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := newHTTPKeySource(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := src.load()
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("load(%s) = %v, want error: %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("load(%s) = %q, want %q", tt.path, b, tt.want)
+		}
+	}
+}
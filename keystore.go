@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keySourceState is the most recently loaded content of a key source.
+type keySourceState struct {
+	*keySourceSpec
+	content []byte
+	keys    map[string]*keyOptions
+}
+
+// keyStore holds the currently authorized and revoked keys. Both sets are
+// swapped atomically on reload, so that connections which are already
+// authenticated (and their sessions) are unaffected.
+type keyStore struct {
+	sources []*keySourceState
+
+	revokedPath    string // empty if no revocation list is configured
+	revokedRefresh time.Duration
+
+	keys    atomic.Pointer[map[string]*keyOptions]
+	revoked atomic.Pointer[revocationList]
+
+	mu             sync.Mutex // protects the fields below and serializes reloads
+	revokedContent []byte
+}
+
+func newKeyStore(specs []*keySourceSpec, revokedPath string, revokedRefresh time.Duration) *keyStore {
+	ks := &keyStore{
+		revokedPath:    revokedPath,
+		revokedRefresh: revokedRefresh,
+	}
+	for _, spec := range specs {
+		ks.sources = append(ks.sources, &keySourceState{keySourceSpec: spec})
+	}
+	empty := make(map[string]*keyOptions)
+	ks.keys.Store(&empty)
+	return ks
+}
+
+// lookup returns the keyOptions of pubKey, if pubKey is authorized.
+func (ks *keyStore) lookup(pubKey ssh.PublicKey) (*keyOptions, bool) {
+	opts, ok := (*ks.keys.Load())[string(pubKey.Marshal())]
+	return opts, ok
+}
+
+// isRevoked reports whether pubKey (a plain key or a certificate) is listed
+// in the revocation list.
+func (ks *keyStore) isRevoked(pubKey ssh.PublicKey) bool {
+	return ks.revoked.Load().revokes(pubKey)
+}
+
+// loadSource loads the keys of src. If a file source was removed, it no
+// longer authorizes any key. On any other error, the previously loaded keys
+// of src stay in effect.
+func (ks *keyStore) loadSource(src *keySourceState) error {
+	b, err := src.source.load()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if src.keys != nil && bytes.Equal(b, src.content) {
+		return err // unchanged
+	}
+	keys, perr := parseAuthorizedKeys(src.name, b)
+	if perr != nil {
+		return perr
+	}
+	src.content, src.keys = b, keys
+	// Merge all sources. When a key is listed in multiple sources, the
+	// options of the first source apply.
+	merged := make(map[string]*keyOptions)
+	for i := len(ks.sources) - 1; i >= 0; i-- {
+		for k, opts := range ks.sources[i].keys {
+			merged[k] = opts
+		}
+	}
+	ks.keys.Store(&merged)
+	log.Printf("loaded %d authorized keys from %s (%d in total)", len(keys), src.name, len(merged))
+	return err
+}
+
+// loadRevoked loads the revocation list. On error, the previously loaded
+// revocation list stays in effect.
+func (ks *keyStore) loadRevoked() error {
+	if ks.revokedPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(ks.revokedPath)
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.revoked.Load() != nil && bytes.Equal(b, ks.revokedContent) {
+		return nil // unchanged
+	}
+	revoked, err := loadRevokedKeys(ks.revokedPath)
+	if err != nil {
+		return err
+	}
+	ks.revokedContent = b
+	ks.revoked.Store(revoked)
+	return nil
+}
+
+// revocationsLoaded reports whether the revocation list was loaded, if one
+// is configured.
+func (ks *keyStore) revocationsLoaded() bool {
+	return ks.revokedPath == "" || ks.revoked.Load() != nil
+}
+
+// load loads the revocation list and all key sources. Errors are logged,
+// so that one unavailable source does not prevent logging in with the keys
+// of the others. An error is only returned if the revocation list was never
+// loaded (revoked keys would be accepted otherwise), or if no keys could be
+// loaded at all, in which case it is the first error.
+func (ks *keyStore) load() error {
+	if err := ks.loadRevoked(); err != nil {
+		if !ks.revocationsLoaded() {
+			return fmt.Errorf("loading revoked keys: %v", err)
+		}
+		log.Printf("loading revoked keys: %v", err)
+	}
+	var first error
+	for _, src := range ks.sources {
+		if err := ks.loadSource(src); err != nil {
+			log.Printf("loading keys from %s: %v", src.name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if len(*ks.keys.Load()) > 0 {
+		return nil
+	}
+	return first
+}
+
+// poll calls load every interval.
+func poll(interval time.Duration, name string, load func() error) {
+	for range time.Tick(interval) {
+		if err := load(); err != nil && !os.IsNotExist(err) {
+			log.Printf("reloading %s: %v", name, err)
+		}
+	}
+}
+
+// watch reloads all keys on SIGHUP and each source according to its refresh
+// interval.
+func (ks *keyStore) watch() {
+	for _, src := range ks.sources {
+		if src.refresh > 0 {
+			go poll(src.refresh, src.name, func() error { return ks.loadSource(src) })
+		}
+	}
+	if ks.revokedPath != "" && ks.revokedRefresh > 0 {
+		go poll(ks.revokedRefresh, ks.revokedPath, ks.loadRevoked)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("SIGHUP received, reloading keys")
+		ks.load()
+	}
+}
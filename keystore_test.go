@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyStoreLoad(t *testing.T) {
+	dir := t.TempDir()
+	pub, _ := newTestKey(t)
+	valid := filepath.Join(dir, "authorized_keys")
+	if err := os.WriteFile(valid, ssh.MarshalAuthorizedKey(pub), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+	corrupt := filepath.Join(dir, "corrupt")
+	if err := os.WriteFile(corrupt, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	failing := "http://127.0.0.1:0/keys"
+
+	for _, tt := range []struct {
+		name    string
+		sources string
+		revoked string
+		wantErr bool
+	}{
+		{"valid", valid, "", false},
+		{"one source failing", failing + "," + missing + "," + valid, "", false},
+		// Without the revocation list, revoked keys would be accepted.
+		{"revocation list missing", valid, missing, true},
+		{"revocation list corrupt", valid, corrupt, true},
+		{"all sources failing", failing + "," + missing, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			specs, err := parseKeySources(tt.sources, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ks := newKeyStore(specs, tt.revoked, 0)
+			err = ks.load()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("load() = %v, want error: %v", err, tt.wantErr)
+			}
+			if _, ok := ks.lookup(pub); ok == tt.wantErr {
+				t.Errorf("lookup() = %v, want %v", ok, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyStoreReloadRevoked(t *testing.T) {
+	dir := t.TempDir()
+	pub, _ := newTestKey(t)
+	revokedPub, _ := newTestKey(t)
+	keys := filepath.Join(dir, "authorized_keys")
+	if err := os.WriteFile(keys, ssh.MarshalAuthorizedKey(pub), 0600); err != nil {
+		t.Fatal(err)
+	}
+	revoked := filepath.Join(dir, "revoked_keys")
+	if err := os.WriteFile(revoked, ssh.MarshalAuthorizedKey(revokedPub), 0600); err != nil {
+		t.Fatal(err)
+	}
+	specs, err := parseKeySources(keys, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := newKeyStore(specs, revoked, 0)
+	if err := ks.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// When reloading fails, the previous revocation list stays in effect.
+	if err := os.WriteFile(revoked, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.load(); err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	if !ks.isRevoked(revokedPub) {
+		t.Errorf("key no longer revoked after a failed reload")
+	}
+	if ks.isRevoked(pub) {
+		t.Errorf("authorized key unexpectedly revoked")
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// krlMagic starts every binary OpenSSH key revocation list.
+//
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.krl
+const krlMagic = "SSHKRL\n\x00"
+
+// KRL section types, see PROTOCOL.krl.
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+// krlCerts are the certificates revoked for one CA.
+type krlCerts struct {
+	// caKey is the marshaled CA public key, or empty if the section
+	// applies to certificates signed by any CA.
+	caKey   string
+	serials map[uint64]bool
+	ranges  [][2]uint64
+	bitmaps []krlBitmap
+	keyIDs  map[string]bool
+}
+
+type krlBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+func (c *krlCerts) revokes(cert *ssh.Certificate) bool {
+	if c.caKey != "" && c.caKey != string(cert.SignatureKey.Marshal()) {
+		return false
+	}
+	if c.keyIDs[cert.KeyId] || c.serials[cert.Serial] {
+		return true
+	}
+	for _, r := range c.ranges {
+		if cert.Serial >= r[0] && cert.Serial <= r[1] {
+			return true
+		}
+	}
+	for _, b := range c.bitmaps {
+		if cert.Serial < b.offset {
+			continue
+		}
+		if idx := cert.Serial - b.offset; idx < uint64(b.bits.BitLen()) && b.bits.Bit(int(idx)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// revocationList is a set of revoked keys and certificates, loaded from
+// either a plain list of public keys or a binary OpenSSH KRL.
+type revocationList struct {
+	keys   map[string]bool // marshaled public keys
+	sha1   map[string]bool
+	sha256 map[string]bool
+	certs  []*krlCerts
+}
+
+// revokesKey reports whether the plain (non-certificate) key is revoked.
+func (rl *revocationList) revokesKey(pubKey ssh.PublicKey) bool {
+	blob := pubKey.Marshal()
+	if rl.keys[string(blob)] {
+		return true
+	}
+	if len(rl.sha1) > 0 {
+		sum := sha1.Sum(blob)
+		if rl.sha1[string(sum[:])] {
+			return true
+		}
+	}
+	if len(rl.sha256) > 0 {
+		sum := sha256.Sum256(blob)
+		if rl.sha256[string(sum[:])] {
+			return true
+		}
+	}
+	return false
+}
+
+// revokes reports whether pubKey must be rejected. For certificates, the
+// certificate itself (by serial or key ID), the certified key and the
+// signing CA key are checked.
+func (rl *revocationList) revokes(pubKey ssh.PublicKey) bool {
+	if rl == nil {
+		return false
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return rl.revokesKey(pubKey)
+	}
+	for _, c := range rl.certs {
+		if c.revokes(cert) {
+			return true
+		}
+	}
+	return rl.revokesKey(cert.Key) || rl.revokesKey(cert.SignatureKey)
+}
+
+// loadRevokedKeys reads the file at path, which contains either a binary
+// OpenSSH KRL (as created by ssh-keygen -k) or public keys, one per line.
+func loadRevokedKeys(path string) (*revocationList, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rl := &revocationList{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+	if bytes.HasPrefix(b, []byte(krlMagic)) {
+		if err := rl.parseKRL(b[len(krlMagic):]); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return rl, nil
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for lineNum := 1; s.Scan(); lineNum++ {
+		if tr := strings.TrimSpace(s.Text()); tr == "" || strings.HasPrefix(tr, "#") {
+			continue
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(s.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		rl.keys[string(pubKey.Marshal())] = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+var errKRLShort = errors.New("truncated KRL")
+
+// krlReader decodes the SSH wire encoding used in KRLs.
+type krlReader struct {
+	b   []byte
+	err error
+}
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errKRLShort
+		return nil
+	}
+	res := r.b[:n]
+	r.b = r.b[n:]
+	return res
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	n := r.uint32()
+	if r.err == nil && uint64(n) > uint64(len(r.b)) {
+		r.err = errKRLShort
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *krlReader) empty() bool {
+	return r.err != nil || len(r.b) == 0
+}
+
+// skipSignatures skips the signature sections at the end of a KRL, whose
+// section type was just read. Unlike other sections, a signature section
+// consists of two strings (signature_key and signature), and it may only be
+// followed by further signature sections. Signatures are not verified
+// (neither does sshd).
+func (r *krlReader) skipSignatures() error {
+	for {
+		r.string() // signature_key
+		r.string() // signature
+		if r.empty() {
+			return r.err
+		}
+		if typ := r.byte(); typ != krlSectionSignature {
+			return fmt.Errorf("KRL section type %d after signature", typ)
+		}
+	}
+}
+
+func (rl *revocationList) parseKRL(b []byte) error {
+	r := &krlReader{b: b}
+	if version := r.uint32(); r.err == nil && version != 1 {
+		return fmt.Errorf("unsupported KRL format version %d", version)
+	}
+	r.uint64() // krl_version
+	r.uint64() // generated_date
+	r.uint64() // flags
+	r.string() // reserved
+	r.string() // comment
+	for !r.empty() {
+		typ := r.byte()
+		if typ == krlSectionSignature {
+			return r.skipSignatures()
+		}
+		data := &krlReader{b: r.string()}
+		if r.err != nil {
+			break
+		}
+		switch typ {
+		case krlSectionCertificates:
+			if err := rl.parseKRLCerts(data); err != nil {
+				return err
+			}
+		case krlSectionExplicitKey:
+			for !data.empty() {
+				blob := data.string()
+				pubKey, err := ssh.ParsePublicKey(blob)
+				if err != nil {
+					return fmt.Errorf("explicit key section: %v", err)
+				}
+				rl.keys[string(pubKey.Marshal())] = true
+			}
+		case krlSectionFingerprintSHA1:
+			for !data.empty() {
+				rl.sha1[string(data.string())] = true
+			}
+		case krlSectionFingerprintSHA256:
+			for !data.empty() {
+				rl.sha256[string(data.string())] = true
+			}
+		default:
+			return fmt.Errorf("unsupported KRL section type %d", typ)
+		}
+		if data.err != nil {
+			return data.err
+		}
+	}
+	return r.err
+}
+
+func (rl *revocationList) parseKRLCerts(r *krlReader) error {
+	c := &krlCerts{
+		serials: make(map[uint64]bool),
+		keyIDs:  make(map[string]bool),
+	}
+	if caKey := r.string(); len(caKey) > 0 {
+		pubKey, err := ssh.ParsePublicKey(caKey)
+		if err != nil {
+			return fmt.Errorf("certificate section: CA key: %v", err)
+		}
+		c.caKey = string(pubKey.Marshal())
+	}
+	r.string() // reserved
+	for !r.empty() {
+		typ := r.byte()
+		data := &krlReader{b: r.string()}
+		if r.err != nil {
+			break
+		}
+		switch typ {
+		case krlSectionCertSerialList:
+			for !data.empty() {
+				c.serials[data.uint64()] = true
+			}
+		case krlSectionCertSerialRange:
+			lo, hi := data.uint64(), data.uint64()
+			c.ranges = append(c.ranges, [2]uint64{lo, hi})
+		case krlSectionCertSerialBitmap:
+			offset := data.uint64()
+			bits := new(big.Int).SetBytes(data.string())
+			c.bitmaps = append(c.bitmaps, krlBitmap{offset: offset, bits: bits})
+		case krlSectionCertKeyID:
+			for !data.empty() {
+				c.keyIDs[string(data.string())] = true
+			}
+		default:
+			return fmt.Errorf("unsupported KRL certificate section type %#x", typ)
+		}
+		if data.err != nil {
+			return data.err
+		}
+	}
+	rl.certs = append(rl.certs, c)
+	return r.err
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// krlString encodes b as an SSH wire format string.
+func krlString(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+// krlSection encodes a KRL section (or certificate subsection) of the
+// specified type.
+func krlSection(typ byte, data ...[]byte) []byte {
+	return append([]byte{typ}, krlString(bytes.Join(data, nil))...)
+}
+
+// buildKRL returns a KRL consisting of the specified sections.
+func buildKRL(sections ...[]byte) []byte {
+	b := []byte(krlMagic)
+	b = binary.BigEndian.AppendUint32(b, 1) // format_version
+	b = binary.BigEndian.AppendUint64(b, 1) // krl_version
+	b = binary.BigEndian.AppendUint64(b, 0) // generated_date
+	b = binary.BigEndian.AppendUint64(b, 0) // flags
+	b = append(b, krlString(nil)...)        // reserved
+	b = append(b, krlString(nil)...)        // comment
+	return append(b, bytes.Join(sections, nil)...)
+}
+
+func newTestKey(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey(), signer
+}
+
+func newTestCert(t *testing.T, ca ssh.Signer, serial uint64, keyID string) *ssh.Certificate {
+	t.Helper()
+	pub, _ := newTestKey(t)
+	cert := &ssh.Certificate{
+		Key:         pub,
+		Serial:      serial,
+		CertType:    ssh.UserCert,
+		KeyId:       keyID,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func loadTestRevocationList(t *testing.T, b []byte) (*revocationList, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadRevokedKeys(path)
+}
+
+func TestRevokedKeysList(t *testing.T) {
+	revoked, _ := newTestKey(t)
+	other, _ := newTestKey(t)
+	b := append([]byte("# comment\n\n"), ssh.MarshalAuthorizedKey(revoked)...)
+	rl, err := loadTestRevocationList(t, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rl.revokes(revoked) {
+		t.Errorf("listed key not revoked")
+	}
+	if rl.revokes(other) {
+		t.Errorf("unlisted key revoked")
+	}
+}
+
+func TestParseKRL(t *testing.T) {
+	explicit, explicitSigner := newTestKey(t)
+	fingerprinted, _ := newTestKey(t)
+	other, _ := newTestKey(t)
+	caKey, ca := newTestKey(t)
+	_, otherCA := newTestKey(t)
+	sum := sha256.Sum256(fingerprinted.Marshal())
+
+	bitmap := make([]byte, 8)
+	bitmap[7] = 0x05 // offset+0 and offset+2
+	certs := krlSection(krlSectionCertificates,
+		krlString(caKey.Marshal()),
+		krlString(nil), // reserved
+		krlSection(krlSectionCertSerialList, binary.BigEndian.AppendUint64(nil, 42)),
+		krlSection(krlSectionCertSerialRange,
+			binary.BigEndian.AppendUint64(nil, 100),
+			binary.BigEndian.AppendUint64(nil, 200)),
+		krlSection(krlSectionCertSerialBitmap,
+			binary.BigEndian.AppendUint64(nil, 1000),
+			krlString(bitmap)),
+		krlSection(krlSectionCertKeyID, krlString([]byte("mallory"))))
+	sections := [][]byte{
+		krlSection(krlSectionExplicitKey, krlString(explicit.Marshal())),
+		krlSection(krlSectionFingerprintSHA256, krlString(sum[:])),
+		certs,
+	}
+
+	for _, tt := range []struct {
+		name     string
+		sections [][]byte
+	}{
+		{"unsigned", sections},
+		{
+			"signed",
+			append(sections,
+				[]byte{krlSectionSignature},
+				krlString(caKey.Marshal()),
+				krlString([]byte("signature"))),
+		},
+		{
+			"signed twice",
+			append(sections,
+				[]byte{krlSectionSignature},
+				krlString(caKey.Marshal()),
+				krlString([]byte("signature")),
+				[]byte{krlSectionSignature},
+				krlString(caKey.Marshal()),
+				krlString([]byte("signature"))),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, err := loadTestRevocationList(t, buildKRL(tt.sections...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				desc string
+				key  ssh.PublicKey
+				want bool
+			}{
+				{"explicit key", explicit, true},
+				{"SHA256 fingerprint", fingerprinted, true},
+				{"other key", other, false},
+				{"serial 42", newTestCert(t, ca, 42, "alice"), true},
+				{"serial 43", newTestCert(t, ca, 43, "alice"), false},
+				{"serial in range", newTestCert(t, ca, 150, "alice"), true},
+				{"serial in bitmap", newTestCert(t, ca, 1002, "alice"), true},
+				{"serial not in bitmap", newTestCert(t, ca, 1001, "alice"), false},
+				{"key ID", newTestCert(t, ca, 1, "mallory"), true},
+				{"serial 42 of other CA", newTestCert(t, otherCA, 42, "alice"), false},
+				{"certificate signed by revoked key", newTestCert(t, explicitSigner, 1, "alice"), true},
+			} {
+				if got := rl.revokes(c.key); got != c.want {
+					t.Errorf("%s: revokes = %v, want %v", c.desc, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseKRLErrors(t *testing.T) {
+	key, _ := newTestKey(t)
+	valid := krlSection(krlSectionExplicitKey, krlString(key.Marshal()))
+	version2 := buildKRL()
+	binary.BigEndian.PutUint32(version2[len(krlMagic):], 2)
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"unsupported version", version2},
+		{"truncated", buildKRL(valid)[:len(buildKRL(valid))-1]},
+		{"unknown section", buildKRL(krlSection(0x42, nil))},
+		{"section after signature", buildKRL(
+			[]byte{krlSectionSignature},
+			krlString(key.Marshal()),
+			krlString([]byte("signature")),
+			valid)},
+		{"truncated signature", buildKRL(
+			[]byte{krlSectionSignature},
+			krlString(key.Marshal()))},
+	} {
+		if _, err := loadTestRevocationList(t, tt.b); err == nil {
+			t.Errorf("%s: loading unexpectedly succeeded", tt.name)
+		}
+	}
+}
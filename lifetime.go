@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// activity tracks the number of authenticated connections, so that
+// breakglass can exit once nobody has used it for a while.
+type activity struct {
+	mu        sync.Mutex
+	active    int
+	idleSince time.Time
+}
+
+// usage is the activity of this breakglass process.
+var usage = newActivity()
+
+func newActivity() *activity {
+	return &activity{idleSince: time.Now()}
+}
+
+func (a *activity) begin() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active++
+}
+
+func (a *activity) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active--
+	if a.active == 0 {
+		a.idleSince = time.Now()
+	}
+}
+
+// idle returns for how long there have been no active connections.
+func (a *activity) idle() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.active > 0 {
+		return 0
+	}
+	return time.Since(a.idleSince)
+}
+
+// execCommands are the process groups of the running non-PTY commands, which
+// run in their own session and would therefore outlive breakglass.
+var execCommands = struct {
+	sync.Mutex
+	m map[int]bool
+}{m: make(map[int]bool)}
+
+// trackExecCommand registers the process group pgid until untrack is called.
+func trackExecCommand(pgid int) (untrack func()) {
+	execCommands.Lock()
+	defer execCommands.Unlock()
+	execCommands.m[pgid] = true
+	return func() {
+		execCommands.Lock()
+		defer execCommands.Unlock()
+		delete(execCommands.m, pgid)
+	}
+}
+
+// killExecCommands kills the process groups of all running non-PTY commands,
+// like cancelling their session would.
+func killExecCommands() {
+	execCommands.Lock()
+	defer execCommands.Unlock()
+	for pgid := range execCommands.m {
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+// waitForShutdown blocks until breakglass was idle for idleTimeout or ran for
+// maxLifetime (a zero duration disables the respective limit) and returns
+// the reason for shutting down.
+func waitForShutdown(a *activity, idleTimeout, maxLifetime time.Duration) string {
+	var deadline <-chan time.Time
+	if maxLifetime > 0 {
+		deadline = time.After(maxLifetime)
+	}
+	var tick <-chan time.Time
+	if idleTimeout > 0 {
+		// Check often enough to not overshoot the idle timeout by
+		// much, but at most once a second.
+		tick = time.NewTicker(max(idleTimeout/10, time.Second)).C
+	}
+	for {
+		select {
+		case <-deadline:
+			return "maximum lifetime of " + maxLifetime.String() + " reached"
+		case <-tick:
+			if a.idle() >= idleTimeout {
+				return "idle for " + idleTimeout.String()
+			}
+		}
+	}
+}
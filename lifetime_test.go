@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestActivityIdle(t *testing.T) {
+	a := newActivity()
+	a.begin()
+	if got := a.idle(); got != 0 {
+		t.Errorf("idle() = %v with an active connection, want 0", got)
+	}
+	a.end()
+	time.Sleep(10 * time.Millisecond)
+	if got := a.idle(); got < 10*time.Millisecond {
+		t.Errorf("idle() = %v, want at least 10ms", got)
+	}
+}
+
+func TestKillExecCommands(t *testing.T) {
+	// The background process keeps running after sh exits, but is in the
+	// same process group.
+	cmd := exec.Command("sh", "-c", "sleep 60 & echo $!; wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	untrack := trackExecCommand(cmd.Process.Pid)
+	defer untrack()
+	var pid int
+	if _, err := fmt.Fscan(out, &pid); err != nil {
+		t.Fatal(err)
+	}
+
+	killExecCommands()
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("command exited successfully, want killed")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("command not killed")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("background process %d not killed", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// processRunning reports whether process pid exists and is not a zombie
+// (the background process is reparented, so the test cannot reap it).
+func processRunning(pid int) bool {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	_, fields, ok := strings.Cut(string(b), ") ")
+	return ok && !strings.HasPrefix(fields, "Z")
+}
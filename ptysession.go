@@ -0,0 +1,458 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ptySession is a command running on a PTY. Its output is read continuously
+// and sent to all attached clients. Persistent sessions (see
+// -persistent_session_timeout) keep running when their last client
+// disconnects, so that a later connection can attach to them again.
+type ptySession struct {
+	id         string
+	command    string
+	ptyf       *os.File
+	process    *os.Process
+	credential *syscall.Credential
+	started    time.Time
+	persistent bool
+	audit      *slog.Logger
+	rec        *recorder // non-nil if the session is being recorded
+
+	mu          sync.Mutex
+	done        bool // the command exited
+	closed      bool // ptyf was closed by hangup
+	clients     map[*session]*ptyClient
+	detachedAt  time.Time
+	detachTimer *time.Timer
+}
+
+// ptyClientQueue is the number of output chunks buffered per client. When a
+// read-write client falls further behind, the session waits for it, like a
+// slow terminal would. Read-only clients which fall further behind (e.g.
+// because their connection broke) are disconnected instead of stalling the
+// session for everyone.
+const ptyClientQueue = 256
+
+// ptyClient is a session attached to a ptySession.
+type ptyClient struct {
+	readOnly      bool
+	width, height uint32
+	wpx, hpx      uint32
+
+	out    chan []byte
+	gone   chan struct{}    // closed once the client was removed
+	status *os.ProcessState // set before gone is closed if the command exited
+	reason string           // why the client was disconnected, if it was
+}
+
+// ptySessions are the running PTY sessions, keyed by ID.
+var ptySessions = struct {
+	sync.Mutex
+	m map[string]*ptySession
+}{m: make(map[string]*ptySession)}
+
+// newPTYSession takes over the PTY of session s, on which cmd was started,
+// and attaches s to the new ptySession.
+func newPTYSession(s *session, cmd *exec.Cmd, command string) *ptySession {
+	ps := &ptySession{
+		id:         newSessionID(),
+		command:    command,
+		ptyf:       s.ptyf,
+		process:    cmd.Process,
+		credential: s.opts.credential,
+		started:    time.Now(),
+		persistent: *persistentSessionTimeout > 0,
+		audit:      s.audit,
+		clients:    make(map[*session]*ptyClient),
+	}
+	if *recordDir != "" {
+		hdr := asciicastHeader{
+			Width:   s.width,
+			Height:  s.height,
+			Command: command,
+			Env:     map[string]string{"TERM": s.term, "SHELL": cmd.Path},
+		}
+		rec, err := newRecorder(*recordDir, ps.id, *recordMaxSize, hdr)
+		if err != nil {
+			log.Printf("recording session: %v", err)
+		} else {
+			ps.rec = rec
+			s.audit.Info("recording", "session", ps.id, "path", rec.path)
+		}
+	}
+	ptySessions.Lock()
+	ptySessions.m[ps.id] = ps
+	ptySessions.Unlock()
+	if ps.persistent {
+		fmt.Fprintf(s.channel.Stderr(), "breakglass: persistent session %s (reattach using: breakglass -attach=%s <hostname>)\r\n", ps.id, ps.id)
+	}
+	ps.attach(s, false, false) // cannot fail: the command did not exit yet
+	go ps.pump()
+	return ps
+}
+
+// lookupPTYSession returns the session with the specified ID, if s may
+// attach to it.
+func lookupPTYSession(s *session, id string) (*ptySession, error) {
+	ptySessions.Lock()
+	ps, ok := ptySessions.m[id]
+	ptySessions.Unlock()
+	if !ok || !ps.accessibleTo(s) {
+		return nil, fmt.Errorf("no such session: %q", id)
+	}
+	return ps, nil
+}
+
+// accessibleTo reports whether s may attach to ps: root may attach to all
+// sessions, unprivileged users to the sessions of the same uid.
+func (ps *ptySession) accessibleTo(s *session) bool {
+	cred := s.opts.credential
+	if cred == nil {
+		return true
+	}
+	return ps.credential != nil && ps.credential.Uid == cred.Uid
+}
+
+// pump copies the output of the command to all attached clients until the
+// command exits.
+func (ps *ptySession) pump() {
+	var rec io.Writer = io.Discard
+	if ps.rec != nil {
+		rec = &recorderWriter{r: ps.rec, typ: "o"}
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := ps.ptyf.Read(buf)
+		if n > 0 {
+			rec.Write(buf[:n])
+			chunk := append([]byte(nil), buf[:n]...)
+			var writers []*ptyClient
+			ps.mu.Lock()
+			for s, c := range ps.clients {
+				if !c.readOnly {
+					writers = append(writers, c)
+					continue
+				}
+				select {
+				case c.out <- chunk:
+				default:
+					c.reason = "connection too slow, detached from session " + ps.id
+					ps.removeLocked(s)
+				}
+			}
+			ps.mu.Unlock()
+			// Wait for read-write clients without holding ps.mu, so that
+			// they can still detach.
+			for _, c := range writers {
+				select {
+				case c.out <- chunk:
+				case <-c.gone:
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	state, err := ps.process.Wait()
+	if err != nil {
+		log.Printf("pty session %s: %v", ps.id, err)
+	}
+	ps.exited(state)
+}
+
+// exited reports the exit status of the command to all attached clients and
+// releases the resources of the session.
+func (ps *ptySession) exited(state *os.ProcessState) {
+	ptySessions.Lock()
+	delete(ptySessions.m, ps.id)
+	ptySessions.Unlock()
+
+	ps.mu.Lock()
+	ps.done = true
+	if ps.detachTimer != nil {
+		ps.detachTimer.Stop()
+	}
+	if len(ps.clients) == 0 && state != nil {
+		ps.audit.Info("exit", "command", ps.command, "status", state.ExitCode())
+	}
+	for s, c := range ps.clients {
+		c.status = state
+		ps.removeLocked(s)
+	}
+	ps.mu.Unlock()
+
+	if ps.rec != nil {
+		ps.rec.close()
+	}
+	ps.ptyf.Close()
+}
+
+// attach attaches s to ps. Output is sent to all clients, input is only
+// accepted from clients which are not readOnly. If exclusive is true, all
+// other clients are detached (their connection might have broken without
+// breakglass noticing yet).
+func (ps *ptySession) attach(s *session, readOnly, exclusive bool) error {
+	c := &ptyClient{
+		readOnly: readOnly,
+		width:    s.width,
+		height:   s.height,
+		wpx:      s.widthPixels,
+		hpx:      s.heightPixels,
+		out:      make(chan []byte, ptyClientQueue),
+		gone:     make(chan struct{}),
+	}
+
+	ps.mu.Lock()
+	if ps.done {
+		ps.mu.Unlock()
+		return fmt.Errorf("session %s exited", ps.id)
+	}
+	mode := "read-write"
+	if readOnly {
+		mode = "read-only"
+	}
+	// The other clients are notified after unlocking ps.mu, as writing to
+	// their channels can block.
+	var notify []ssh.Channel
+	for other, oc := range ps.clients {
+		if exclusive {
+			oc.reason = "session " + ps.id + " was attached elsewhere"
+			continue
+		}
+		notify = append(notify, other.channel)
+	}
+	ps.clients[s] = c
+	if ps.detachTimer != nil {
+		ps.detachTimer.Stop()
+		ps.detachTimer = nil
+	}
+	if exclusive {
+		// Remove the other clients only now that s is attached, so that
+		// the session is not considered abandoned in between.
+		for other := range ps.clients {
+			if other != s {
+				ps.removeLocked(other)
+			}
+		}
+	}
+	ps.resizeLocked()
+	ps.mu.Unlock()
+
+	for _, ch := range notify {
+		fmt.Fprintf(ch.Stderr(), "\r\nbreakglass: %s joined session %s (%s)\r\n", s.sconn.User(), ps.id, mode)
+	}
+
+	s.pty = ps
+	if !readOnly {
+		// Permit signal and break requests.
+		s.ptyf = ps.ptyf
+		s.process = ps.process
+	}
+
+	go func() {
+		for {
+			select {
+			case b := <-c.out:
+				s.channel.Write(b)
+				continue
+			case <-c.gone:
+			}
+			break
+		}
+		// Send the output which was queued before the client was removed.
+		for len(c.out) > 0 {
+			s.channel.Write(<-c.out)
+		}
+		if c.status != nil {
+			s.sendExitStatus(ps.command, c.status)
+		} else if c.reason != "" {
+			fmt.Fprintf(s.channel.Stderr(), "\r\nbreakglass: %s\r\n", c.reason)
+		}
+		s.channel.Close()
+	}()
+
+	go func() {
+		if readOnly {
+			io.Copy(io.Discard, s.channel)
+		} else {
+			var input io.Reader = s.channel
+			if ps.rec != nil {
+				input = io.TeeReader(s.channel, &recorderWriter{r: ps.rec, typ: "i"})
+			}
+			io.Copy(ps.ptyf, input)
+		}
+		ps.detach(s)
+	}()
+	return nil
+}
+
+// removeLocked detaches client s, whose channel is closed once all pending
+// output was sent. Unless the command exited, non-persistent sessions are
+// terminated when no read-write client is left, and persistent sessions once
+// they were detached for -persistent_session_timeout. ps.mu must be held.
+func (ps *ptySession) removeLocked(s *session) {
+	c, ok := ps.clients[s]
+	if !ok {
+		return
+	}
+	delete(ps.clients, s)
+	close(c.gone)
+	if ps.done {
+		return
+	}
+	if !ps.persistent && !ps.hasWriterLocked() {
+		ps.hangupLocked()
+		return
+	}
+	if ps.persistent && len(ps.clients) == 0 {
+		ps.detachedAt = time.Now()
+		ps.detachTimer = time.AfterFunc(*persistentSessionTimeout, ps.hangup)
+	}
+	ps.resizeLocked()
+}
+
+// hasWriterLocked reports whether a read-write client is attached. ps.mu must
+// be held.
+func (ps *ptySession) hasWriterLocked() bool {
+	for _, c := range ps.clients {
+		if !c.readOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// detach is called once client s closed its channel.
+func (ps *ptySession) detach(s *session) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.clients[s]; !ok {
+		return // already removed or exited
+	}
+	ps.removeLocked(s)
+	ps.audit.Info("detach", "session", ps.id)
+}
+
+// hangup terminates the command like a terminal hangup would.
+func (ps *ptySession) hangup() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.hangupLocked()
+}
+
+// hangupLocked is like hangup. ps.mu must be held.
+func (ps *ptySession) hangupLocked() {
+	syscall.Kill(-ps.process.Pid, syscall.SIGHUP)
+	ps.closed = true
+	ps.ptyf.Close()
+}
+
+// hangupAttached terminates the commands of the PTY sessions to which s is
+// attached as a read-write client. Closing the channel of s would only
+// detach it, which leaves persistent sessions running.
+func hangupAttached(s *session) {
+	for _, ps := range listPTYSessions(s) {
+		ps.mu.Lock()
+		c, ok := ps.clients[s]
+		ps.mu.Unlock()
+		if ok && !c.readOnly {
+			ps.audit.Info("hangup", "session", ps.id)
+			ps.hangup()
+		}
+	}
+}
+
+// hangupPTYSessions terminates the commands of all PTY sessions.
+func hangupPTYSessions() {
+	ptySessions.Lock()
+	defer ptySessions.Unlock()
+	for _, ps := range ptySessions.m {
+		ps.hangup()
+	}
+}
+
+// resize updates the window size of client s.
+func (ps *ptySession) resize(s *session, w, h, wpx, hpx uint32) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	c, ok := ps.clients[s]
+	if !ok {
+		return
+	}
+	c.width, c.height, c.wpx, c.hpx = w, h, wpx, hpx
+	ps.resizeLocked()
+}
+
+// resizeLocked sets the window size of the PTY to the smallest size among
+// all clients, so that the output fits every client's terminal. The
+// foreground process group is notified even if the size did not change, so
+// that full-screen programs redraw when a client attaches. ps.mu must be
+// held.
+func (ps *ptySession) resizeLocked() {
+	if ps.done || ps.closed {
+		return
+	}
+	var w, h, wpx, hpx uint32
+	for _, c := range ps.clients {
+		if c.width == 0 || c.height == 0 {
+			continue // no pty-req or window-change yet
+		}
+		if w == 0 || c.width < w {
+			w, wpx = c.width, c.wpx
+		}
+		if h == 0 || c.height < h {
+			h, hpx = c.height, c.hpx
+		}
+	}
+	if w == 0 || h == 0 {
+		return
+	}
+	SetWinsize(ps.ptyf.Fd(), w, h, wpx, hpx)
+	if ps.rec != nil {
+		ps.rec.resize(w, h)
+	}
+	if pgrp, err := foregroundPgrp(ps.ptyf); err == nil {
+		syscall.Kill(-pgrp, syscall.SIGWINCH)
+	}
+}
+
+// listPTYSessions returns the sessions accessible to s, sorted by ID (i.e.
+// by start time).
+func listPTYSessions(s *session) []*ptySession {
+	ptySessions.Lock()
+	defer ptySessions.Unlock()
+	var result []*ptySession
+	for _, ps := range ptySessions.m {
+		if ps.accessibleTo(s) {
+			result = append(result, ps)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
+
+// state describes the clients of ps, for listing sessions.
+func (ps *ptySession) state() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	switch n := len(ps.clients); {
+	case n == 1:
+		return "attached"
+	case n > 1:
+		return fmt.Sprintf("attached (%d clients)", n)
+	}
+	return "detached " + time.Since(ps.detachedAt).Round(time.Second).String() + " ago"
+}
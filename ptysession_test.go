@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeChannel is an ssh.Channel whose input is written by the test and whose
+// output is recorded.
+type fakeChannel struct {
+	inr *io.PipeReader
+	inw *io.PipeWriter
+
+	mu       sync.Mutex
+	block    chan struct{} // if non-nil, writes block until it is closed
+	out      bytes.Buffer
+	stderr   bytes.Buffer
+	requests []string
+	closed   chan struct{}
+}
+
+func newFakeChannel() *fakeChannel {
+	inr, inw := io.Pipe()
+	return &fakeChannel{inr: inr, inw: inw, closed: make(chan struct{})}
+}
+
+func (c *fakeChannel) Read(p []byte) (int, error) { return c.inr.Read(p) }
+
+func (c *fakeChannel) Write(p []byte) (int, error) {
+	c.wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(p)
+}
+
+// wait waits until writes are unblocked.
+func (c *fakeChannel) wait() {
+	c.mu.Lock()
+	block := c.block
+	c.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+}
+
+func (c *fakeChannel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+		c.inr.Close()
+	}
+	return nil
+}
+
+func (c *fakeChannel) CloseWrite() error { return nil }
+
+func (c *fakeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, name)
+	return true, nil
+}
+
+func (c *fakeChannel) Stderr() io.ReadWriter { return fakeStderr{c} }
+
+type fakeStderr struct{ c *fakeChannel }
+
+func (s fakeStderr) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (s fakeStderr) Write(p []byte) (int, error) {
+	s.c.wait()
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	return s.c.stderr.Write(p)
+}
+
+// blockWrites blocks writes to the channel, like a stalled connection would,
+// until the returned function is called.
+func (c *fakeChannel) blockWrites() (unblock func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	block := make(chan struct{})
+	c.block = block
+	return sync.OnceFunc(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.block = nil
+		close(block)
+	})
+}
+
+// output returns the output and stderr of the channel so far.
+func (c *fakeChannel) output() (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.String(), c.stderr.String()
+}
+
+// waitClosed waits until the channel was closed.
+func (c *fakeChannel) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("channel not closed")
+	}
+}
+
+func (c *fakeChannel) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// fakeConn provides the user name of a connection.
+type fakeConn struct {
+	ssh.Conn
+	user string
+}
+
+func (c fakeConn) User() string { return c.user }
+
+func newTestSession(user string) (*session, *fakeChannel) {
+	ch := newFakeChannel()
+	return &session{
+		channel: ch,
+		sconn:   &ssh.ServerConn{Conn: fakeConn{user: user}},
+		opts:    &keyOptions{},
+		audit:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		width:   80,
+		height:  24,
+	}, ch
+}
+
+// startTestPTYSession starts the shell script on a PTY, like the exec request
+// handler does.
+func startTestPTYSession(t *testing.T, script string, persistent time.Duration) (*ptySession, *session, *fakeChannel) {
+	t.Helper()
+	old := *persistentSessionTimeout
+	*persistentSessionTimeout = persistent
+	t.Cleanup(func() { *persistentSessionTimeout = old })
+
+	s, ch := newTestSession("alice")
+	var err error
+	s.ptyf, s.ttyf, err = pty.Open()
+	if err != nil {
+		t.Skipf("pty.Open: %v", err)
+	}
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = s.ttyf, s.ttyf, s.ttyf
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	s.ttyf.Close()
+	ps := newPTYSession(s, cmd, script)
+	t.Cleanup(func() {
+		ps.hangup()
+		waitExited(t, ps)
+	})
+	return ps, s, ch
+}
+
+// waitExited waits until the command of ps exited.
+func waitExited(t *testing.T, ps *ptySession) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		ps.mu.Lock()
+		done := ps.done
+		ps.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session %s did not exit", ps.id)
+}
+
+// waitOutput waits until the output of ch contains want.
+func waitOutput(t *testing.T, ch *fakeChannel, want string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if out, _ := ch.output(); strings.Contains(out, want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	out, stderr := ch.output()
+	t.Fatalf("output %q (stderr %q) does not contain %q", out, stderr, want)
+}
+
+func TestPTYSessionHangupAttached(t *testing.T) {
+	ps, s, ch := startTestPTYSession(t, "echo ready; sleep 60", time.Hour)
+	waitOutput(t, ch, "ready")
+
+	viewer, viewerCh := newTestSession("bob")
+	if err := ps.attach(viewer, true, false); err != nil {
+		t.Fatal(err)
+	}
+	// Read-only clients do not terminate the session.
+	hangupAttached(viewer)
+	time.Sleep(100 * time.Millisecond)
+	if viewerCh.isClosed() {
+		t.Fatalf("session hung up by a read-only client")
+	}
+
+	// A session limit of the read-write client terminates even a
+	// persistent session.
+	old := *sessionMaxDuration
+	*sessionMaxDuration = time.Nanosecond
+	defer func() { *sessionMaxDuration = old }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.enforceLimits(ctx, cancel, newTimedChannel(ch))
+	waitExited(t, ps)
+	ch.waitClosed(t)
+	viewerCh.waitClosed(t)
+}
+
+func TestPTYSessionSlowWriter(t *testing.T) {
+	ps, s, ch := startTestPTYSession(t, "read x; seq 1 500000; echo done", 0)
+	unblock := ch.blockWrites()
+	io.WriteString(ch.inw, "x\n")
+
+	// Wait until the output queue of the client is full.
+	ps.mu.Lock()
+	c := ps.clients[s]
+	ps.mu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(c.out) < ptyClientQueue {
+		if time.Now().After(deadline) {
+			t.Fatalf("output queue not full")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The session waits for the read-write client instead of detaching it.
+	ps.mu.Lock()
+	_, attached := ps.clients[s]
+	ps.mu.Unlock()
+	if !attached {
+		t.Fatalf("slow read-write client was detached")
+	}
+	unblock()
+	waitOutput(t, ch, "done")
+	ch.waitClosed(t)
+	if _, stderr := ch.output(); strings.Contains(stderr, "too slow") {
+		t.Errorf("stderr = %q, want no disconnect", stderr)
+	}
+}
+
+func TestPTYSessionExclusiveReadOnly(t *testing.T) {
+	ps, _, ch := startTestPTYSession(t, "echo ready; sleep 60", 0)
+	waitOutput(t, ch, "ready")
+
+	// Watchers must not be able to detach the read-write clients, which
+	// would terminate a non-persistent session.
+	viewer, _ := newTestSession("bob")
+	if err := builtinAttach(viewer, []string{"-r", "-d", ps.id}); err == nil {
+		t.Fatal("builtinAttach(-r -d) succeeded unexpectedly")
+	}
+	ps.mu.Lock()
+	done, clients := ps.done, len(ps.clients)
+	ps.mu.Unlock()
+	if done || clients != 1 {
+		t.Fatalf("done = %v, clients = %d, want a running session with 1 client", done, clients)
+	}
+	ps.hangup()
+	ch.waitClosed(t)
+}
+
+func TestPTYSessionJoinNoticeUnlocked(t *testing.T) {
+	ps, _, ch := startTestPTYSession(t, "echo ready; sleep 60", 0)
+	waitOutput(t, ch, "ready")
+
+	// A stalled client must not block the session while it is notified of
+	// another client joining.
+	unblock := ch.blockWrites()
+	defer unblock()
+	viewer, viewerCh := newTestSession("bob")
+	go ps.attach(viewer, true, false)
+	attached := make(chan struct{})
+	go func() {
+		for {
+			ps.mu.Lock()
+			n := len(ps.clients)
+			ps.mu.Unlock()
+			if n == 2 {
+				close(attached)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	select {
+	case <-attached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session locked while notifying a stalled client")
+	}
+	unblock()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, stderr := ch.output(); strings.Contains(stderr, "bob joined session") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client not notified of bob joining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ps.hangup()
+	ch.waitClosed(t)
+	viewerCh.waitClosed(t)
+}
+
+func TestPTYSessionSlowViewerDetached(t *testing.T) {
+	ps, _, ch := startTestPTYSession(t, "sleep 1; seq 1 500000; sleep 60", 100*time.Millisecond)
+
+	viewer, viewerCh := newTestSession("bob")
+	unblock := viewerCh.blockWrites()
+	defer unblock()
+	if err := ps.attach(viewer, true, true); err != nil {
+		t.Fatal(err)
+	}
+	ch.waitClosed(t)
+
+	// The viewer is detached once it falls behind. As the last client of a
+	// persistent session, this starts -persistent_session_timeout.
+	waitExited(t, ps)
+	unblock()
+	viewerCh.waitClosed(t)
+	if _, stderr := viewerCh.output(); !strings.Contains(stderr, "too slow") {
+		t.Errorf("stderr = %q, want a disconnect message", stderr)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxBanDuration caps the exponential backoff of repeated bans.
+const maxBanDuration = 24 * time.Hour
+
+// hostLimits is the rate limiting state of a single remote IP address.
+type hostLimits struct {
+	handshakes  int // in progress
+	failures    int // consecutive failed authentications
+	bans        int // number of bans so far, for exponential backoff
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+// limiter protects breakglass against brute-force attacks and resource
+// exhaustion by limiting the number of connections (globally), the number of
+// concurrent handshakes (per remote IP) and by temporarily banning remote IPs
+// which repeatedly fail to authenticate.
+type limiter struct {
+	maxConns      int
+	maxHandshakes int
+	maxFailures   int
+	banDuration   time.Duration
+
+	mu    sync.Mutex
+	conns int
+	hosts map[string]*hostLimits
+}
+
+func newLimiter(maxConns, maxHandshakes, maxFailures int, banDuration time.Duration) *limiter {
+	return &limiter{
+		maxConns:      maxConns,
+		maxHandshakes: maxHandshakes,
+		maxFailures:   maxFailures,
+		banDuration:   banDuration,
+		hosts:         make(map[string]*hostLimits),
+	}
+}
+
+// remoteIP returns the IP address of addr without port.
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquire reserves a connection slot and a handshake slot for ip. The
+// caller must call handshakeDone once the handshake finished and release
+// once the connection is closed.
+func (l *limiter) acquire(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	h := l.hosts[ip]
+	if h == nil {
+		h = &hostLimits{}
+		l.hosts[ip] = h
+	}
+	h.lastSeen = now
+	if now.Before(h.bannedUntil) {
+		return fmt.Errorf("banned for another %v", h.bannedUntil.Sub(now).Round(time.Second))
+	}
+	if l.maxConns > 0 && l.conns >= l.maxConns {
+		return fmt.Errorf("too many connections (-max_connections=%d)", l.maxConns)
+	}
+	if l.maxHandshakes > 0 && h.handshakes >= l.maxHandshakes {
+		return fmt.Errorf("too many concurrent handshakes (-max_handshakes_per_ip=%d)", l.maxHandshakes)
+	}
+	l.conns++
+	h.handshakes++
+	return nil
+}
+
+// isAuthFailure reports whether err (as returned by ssh.NewServerConn)
+// means that the remote end tried to authenticate and failed. Clients which
+// disconnect before trying any authentication method (port scans, health
+// checks) also result in an *ssh.ServerAuthError, but without errors.
+func isAuthFailure(err error) bool {
+	var authErr *ssh.ServerAuthError
+	return errors.As(err, &authErr) && len(authErr.Errors) > 0
+}
+
+// handshakeDone records the outcome of a handshake started with acquire, i.e.
+// the error returned by ssh.NewServerConn. Failed logins count towards a ban,
+// and a successful login resets the count. If this results in a ban, its
+// duration is returned.
+func (l *limiter) handshakeDone(ip string, err error) (ban time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.hosts[ip]
+	h.handshakes--
+	if err == nil {
+		h.failures = 0
+		return 0
+	}
+	if !isAuthFailure(err) {
+		return 0
+	}
+	h.failures++
+	if l.maxFailures <= 0 || h.failures < l.maxFailures {
+		return 0
+	}
+	// Each ban lasts twice as long as the previous one.
+	ban = min(l.banDuration<<h.bans, maxBanDuration)
+	if ban <= 0 {
+		ban = maxBanDuration // overflow
+	}
+	h.bans++
+	h.failures = 0
+	h.bannedUntil = time.Now().Add(ban)
+	return ban
+}
+
+// release frees the connection slot reserved by acquire.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+}
+
+// expire forgets about remote IPs which are not banned and were not seen
+// for longer than the maximum ban duration, so that the state does not grow
+// without bounds.
+func (l *limiter) expire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for ip, h := range l.hosts {
+		if h.handshakes == 0 &&
+			now.After(h.bannedUntil) &&
+			now.Sub(h.lastSeen) > maxBanDuration {
+			delete(l.hosts, ip)
+		}
+	}
+}
+
+// expireLoop periodically calls expire.
+func (l *limiter) expireLoop() {
+	for range time.Tick(time.Hour) {
+		l.expire()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errAuthFailed = &ssh.ServerAuthError{Errors: []error{ssh.ErrNoAuth, errors.New("unknown public key")}}
+	errNoAuth     = &ssh.ServerAuthError{} // disconnected before trying to authenticate
+)
+
+func TestIsAuthFailure(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.EOF, false},
+		{errNoAuth, false},
+		{errAuthFailed, true},
+		{fmt.Errorf("handshake: %w", errAuthFailed), true},
+	} {
+		if got := isAuthFailure(tt.err); got != tt.want {
+			t.Errorf("isAuthFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestLimiterBan(t *testing.T) {
+	const ip = "192.0.2.1"
+	l := newLimiter(0, 0, 3, time.Minute)
+	handshake := func(err error) time.Duration {
+		t.Helper()
+		if err := l.acquire(ip); err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		defer l.release()
+		return l.handshakeDone(ip, err)
+	}
+
+	handshake(errAuthFailed)
+	handshake(errAuthFailed)
+	// Handshakes without authentication attempts neither count as a
+	// failure nor reset the count.
+	for i := 0; i < 5; i++ {
+		if ban := handshake(errNoAuth); ban != 0 {
+			t.Fatalf("banned for %v after a handshake without authentication", ban)
+		}
+	}
+	if ban := handshake(errAuthFailed); ban != time.Minute {
+		t.Fatalf("ban = %v after 3 failed logins, want %v", ban, time.Minute)
+	}
+	if err := l.acquire(ip); err == nil {
+		t.Errorf("acquire succeeded while banned")
+	}
+}
+
+func TestLimiterSuccessResets(t *testing.T) {
+	const ip = "192.0.2.1"
+	l := newLimiter(0, 0, 2, time.Minute)
+	for _, err := range []error{errAuthFailed, nil, errAuthFailed} {
+		if err := l.acquire(ip); err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		if ban := l.handshakeDone(ip, err); ban != 0 {
+			t.Errorf("banned for %v, want no ban after a successful login", ban)
+		}
+		l.release()
+	}
+}
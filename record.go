@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// newSessionID returns an identifier for a PTY session, which starts with the
+// time so that IDs sort chronologically.
+func newSessionID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b[:])
+}
+
+// asciicastHeader is the first line of an asciicast v2 file.
+//
+// See https://docs.asciinema.org/manual/asciicast/v2/
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder writes the terminal output, input and size changes of a PTY
+// session into an asciicast v2 file. Once the file reaches maxSize bytes,
+// recording stops.
+type recorder struct {
+	path    string
+	maxSize int64
+
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+	size  int64
+}
+
+// newRecorder creates <dir>/<id>.cast and writes the asciicast header.
+func newRecorder(dir, id string, maxSize int64, hdr asciicastHeader) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, id+".cast")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{
+		path:    path,
+		maxSize: maxSize,
+		f:       f,
+		start:   time.Now(),
+	}
+	hdr.Version = 2
+	hdr.Timestamp = r.start.Unix()
+	b, err := json.Marshal(hdr)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := r.writeLine(b); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) writeLine(b []byte) error {
+	n, err := r.f.Write(append(b, '\n'))
+	r.size += int64(n)
+	return err
+}
+
+// event appends an event of the specified type ("o" for output, "i" for
+// input, "r" for resize, "m" for marker).
+func (r *recorder) event(typ, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return
+	}
+	b, err := json.Marshal([]any{time.Since(r.start).Seconds(), typ, data})
+	if err != nil {
+		return
+	}
+	if r.maxSize > 0 && r.size+int64(len(b)) > r.maxSize {
+		marker, _ := json.Marshal([]any{time.Since(r.start).Seconds(), "m", "recording stopped: size limit reached"})
+		r.writeLine(marker)
+		log.Printf("%s: size limit of %d bytes reached, recording stopped", r.path, r.maxSize)
+		r.f.Close()
+		r.f = nil
+		return
+	}
+	if err := r.writeLine(b); err != nil {
+		log.Printf("%s: %v, recording stopped", r.path, err)
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+func (r *recorder) resize(width, height uint32) {
+	r.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (r *recorder) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// recorderWriter records everything written to it as events of type typ.
+type recorderWriter struct {
+	r       *recorder
+	typ     string
+	pending []byte // incomplete UTF-8 sequence from the previous write
+}
+
+func (w *recorderWriter) Write(p []byte) (int, error) {
+	b := append(w.pending, p...)
+	// Hold back an incomplete UTF-8 sequence at the end, so that it is not
+	// replaced by U+FFFD when encoding the event as JSON.
+	n := len(b)
+	for i := 1; i <= utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				n = len(b) - i
+			}
+			break
+		}
+	}
+	w.pending = append([]byte(nil), b[n:]...)
+	if n > 0 {
+		w.r.event(w.typ, string(b[:n]))
+	}
+	return len(p), nil
+}
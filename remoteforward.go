@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// remoteForwardRequest is the payload of tcpip-forward and
+// cancel-tcpip-forward requests as specified in RFC4254, Section 7.1
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// remoteForwardSuccess is the reply to a tcpip-forward request with port 0.
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+// forwarded-tcpip data struct as specified in RFC4254, Section 7.2
+type remoteForwardChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// remoteForwards are the listeners of a connection's remote port forwardings
+// (ssh -R), keyed by bind address and port (or socket path).
+type remoteForwards struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// bindAddr returns the address on which to listen for the bind address and
+// port of a tcpip-forward request, as permitted by the -forward policy. Like
+// OpenSSH, an empty address refers to the loopback interface.
+func bindAddr(addr string, port uint32) (net.IP, error) {
+	if len(forwardingPolicy) == 0 {
+		return nil, fmt.Errorf("port forwarding is disabled")
+	}
+	if addr == "" {
+		addr = "localhost"
+	}
+	ip := parseAddr(addr)
+	if addr == "localhost" {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if !forwardingPolicy.allows(addr, ip, port) {
+		return nil, fmt.Errorf("port forwarding not allowed for address")
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("host not reachable")
+	}
+	return ip, nil
+}
+
+// handleGlobalRequests handles the global (connection-level) requests of c
+// until the connection is closed, then closes all remote forwardings.
+func (c *connection) handleGlobalRequests(reqs <-chan *ssh.Request) {
+	defer c.closeRemoteForwards()
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			c.handleRemoteForward(req)
+		case "cancel-tcpip-forward":
+			c.handleCancelRemoteForward(req)
+		case "streamlocal-forward@openssh.com":
+			c.handleStreamLocalForward(req)
+		case "cancel-streamlocal-forward@openssh.com":
+			c.handleCancelStreamLocalForward(req)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (c *connection) handleRemoteForward(req *ssh.Request) {
+	var r remoteForwardRequest
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	bind := net.JoinHostPort(r.BindAddr, strconv.Itoa(int(r.BindPort)))
+	deny := func(reason string) {
+		c.audit.Warn("remote forward denied", "bind", bind, "reason", reason)
+		req.Reply(false, nil)
+	}
+	if c.opts.noPortForwarding {
+		deny("port forwarding not permitted for this key")
+		return
+	}
+	if c.opts.credential != nil && r.BindPort != 0 && r.BindPort < 1024 {
+		deny("privileged ports are not available to unprivileged users")
+		return
+	}
+	if r.BindPort > 65535 {
+		deny("invalid port")
+		return
+	}
+	ip, err := bindAddr(r.BindAddr, r.BindPort)
+	if err != nil {
+		deny(err.Error())
+		return
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(r.BindPort))))
+	if err != nil {
+		deny(err.Error())
+		return
+	}
+	port := uint32(ln.Addr().(*net.TCPAddr).Port)
+	key := net.JoinHostPort(r.BindAddr, strconv.Itoa(int(port)))
+	c.remote.mu.Lock()
+	if c.remote.listeners == nil {
+		c.remote.listeners = make(map[string]net.Listener)
+	}
+	c.remote.listeners[key] = ln
+	c.remote.mu.Unlock()
+
+	var reply []byte
+	if r.BindPort == 0 {
+		reply = ssh.Marshal(remoteForwardSuccess{BindPort: port})
+	}
+	req.Reply(true, reply)
+	c.audit.Info("remote forward", "bind", bind, "listen", ln.Addr().String())
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // listener closed
+			}
+			go c.forwardConn(conn, r.BindAddr, port)
+		}
+	}()
+}
+
+// forwardConn forwards conn, which was accepted on the listener for
+// bindAddr:port, to the client in a forwarded-tcpip channel.
+func (c *connection) forwardConn(conn net.Conn, bindAddr string, port uint32) {
+	defer conn.Close()
+	origin := conn.RemoteAddr().(*net.TCPAddr)
+	payload := ssh.Marshal(remoteForwardChannelData{
+		DestAddr:   bindAddr,
+		DestPort:   port,
+		OriginAddr: origin.IP.String(),
+		OriginPort: uint32(origin.Port),
+	})
+	ch, reqs, err := c.sconn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		log.Printf("forwarded-tcpip: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer ch.Close()
+	go func() {
+		defer ch.CloseWrite()
+		io.Copy(ch, conn)
+	}()
+	io.Copy(conn, ch)
+}
+
+func (c *connection) handleCancelRemoteForward(req *ssh.Request) {
+	var r remoteForwardRequest
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	key := net.JoinHostPort(r.BindAddr, strconv.Itoa(int(r.BindPort)))
+	c.remote.mu.Lock()
+	ln, ok := c.remote.listeners[key]
+	delete(c.remote.listeners, key)
+	c.remote.mu.Unlock()
+	if !ok {
+		req.Reply(false, nil)
+		return
+	}
+	ln.Close()
+	c.audit.Info("remote forward cancelled", "bind", key)
+	req.Reply(true, nil)
+}
+
+func (c *connection) closeRemoteForwards() {
+	c.remote.mu.Lock()
+	defer c.remote.mu.Unlock()
+	for key, ln := range c.remote.listeners {
+		ln.Close()
+		delete(c.remote.listeners, key)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBindAddr(t *testing.T) {
+	defer func(p forwardPolicy) { forwardingPolicy = p }(forwardingPolicy)
+	for _, tt := range []struct {
+		policy string
+		addr   string
+		port   uint32
+		want   string // empty if the request must be denied
+	}{
+		// Forwarding is disabled by default, including for the
+		// loopback interface.
+		{"", "", 8080, ""},
+		{"", "localhost", 8080, ""},
+		{"", "127.0.0.1", 8080, ""},
+
+		{"loopback", "", 8080, "127.0.0.1"},
+		{"loopback", "localhost", 8080, "127.0.0.1"},
+		{"loopback", "::1", 8080, "::1"},
+		{"loopback", "0.0.0.0", 8080, ""},
+		{"loopback", "10.0.0.5", 8080, ""},
+
+		{"private-network", "10.0.0.5", 8080, "10.0.0.5"},
+		{"private-network", "192.0.2.1", 8080, ""},
+
+		{"127.0.0.1:8080", "", 8080, "127.0.0.1"},
+		{"127.0.0.1:8080", "", 8081, ""},
+	} {
+		p, err := parseForwardPolicy(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forwardingPolicy = p
+		ip, err := bindAddr(tt.addr, tt.port)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("-forward=%q: bindAddr(%q, %d) = %v, want error", tt.policy, tt.addr, tt.port, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-forward=%q: bindAddr(%q, %d): %v", tt.policy, tt.addr, tt.port, err)
+			continue
+		}
+		if got := ip.String(); got != tt.want {
+			t.Errorf("-forward=%q: bindAddr(%q, %d) = %s, want %s", tt.policy, tt.addr, tt.port, got, tt.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -22,7 +23,7 @@ func (cw *countingWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func scpSink(channel ssh.Channel, req *ssh.Request, cmdline []string) error {
+func scpSink(channel ssh.Channel, req *ssh.Request, cmdline []string, audit *slog.Logger) error {
 	scpFlags := flag.NewFlagSet("scp", flag.ContinueOnError)
 	sink := scpFlags.Bool("t", false, "sink (to)")
 	if err := scpFlags.Parse(cmdline[1:]); err != nil {
@@ -63,6 +64,7 @@ func scpSink(channel ssh.Channel, req *ssh.Request, cmdline []string) error {
 			if err != nil {
 				return err
 			}
+			audit.Info("scp", "file", parts[2], "size", size)
 
 			// Retrieve file contents
 			var cw countingWriter
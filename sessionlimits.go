@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionWarning is how long before a session limit is reached the user is
+// warned.
+const sessionWarning = time.Minute
+
+// timedChannel wraps an ssh.Channel and records the time of the last I/O
+// in either direction.
+type timedChannel struct {
+	ssh.Channel
+	last atomic.Int64 // UnixNano
+}
+
+func newTimedChannel(ch ssh.Channel) *timedChannel {
+	tc := &timedChannel{Channel: ch}
+	tc.touch()
+	return tc
+}
+
+func (c *timedChannel) touch() {
+	c.last.Store(time.Now().UnixNano())
+}
+
+// idle returns the time since the last I/O.
+func (c *timedChannel) idle() time.Duration {
+	return time.Since(time.Unix(0, c.last.Load()))
+}
+
+func (c *timedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *timedChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *timedChannel) Stderr() io.ReadWriter {
+	return timedStderr{c}
+}
+
+type timedStderr struct {
+	c *timedChannel
+}
+
+func (s timedStderr) Read(p []byte) (int, error) {
+	n, err := s.c.Channel.Stderr().Read(p)
+	if n > 0 {
+		s.c.touch()
+	}
+	return n, err
+}
+
+func (s timedStderr) Write(p []byte) (int, error) {
+	n, err := s.c.Channel.Stderr().Write(p)
+	if n > 0 {
+		s.c.touch()
+	}
+	return n, err
+}
+
+// notify prints a message to the user without counting as I/O. The message
+// is sent as stderr data, which ssh(1) displays on the terminal for PTY
+// sessions, too, without interfering with the output of commands.
+func notify(tc *timedChannel, format string, args ...any) {
+	msg := "\r\nbreakglass: " + fmt.Sprintf(format, args...) + "\r\n"
+	tc.Channel.Stderr().Write([]byte(msg))
+}
+
+// enforceLimits closes the session (cancelling ctx, which kills the process
+// group of its command, or hanging up the PTY session it is attached to)
+// once it was idle for -session_idle_timeout or lasted for
+// -session_max_duration. The user is warned shortly before.
+func (s *session) enforceLimits(ctx context.Context, cancel context.CancelFunc, tc *timedChannel) {
+	if *sessionIdleTimeout == 0 && *sessionMaxDuration == 0 {
+		return
+	}
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	warned := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var reason string
+		remaining := time.Duration(1<<63 - 1)
+		if *sessionIdleTimeout > 0 {
+			remaining = *sessionIdleTimeout - tc.idle()
+			reason = fmt.Sprintf("idle timeout of %v", *sessionIdleTimeout)
+		}
+		if *sessionMaxDuration > 0 {
+			if r := *sessionMaxDuration - time.Since(start); r < remaining {
+				remaining = r
+				reason = fmt.Sprintf("maximum session duration of %v", *sessionMaxDuration)
+			}
+		}
+
+		if remaining <= 0 {
+			notify(tc, "%s reached, disconnecting", reason)
+			s.audit.Info("session closed", "reason", reason)
+			// Persistent PTY sessions do not use ctx, as they outlive
+			// the channel.
+			hangupAttached(s)
+			cancel()
+			tc.Close()
+			return
+		}
+		if remaining > sessionWarning {
+			warned = false // the session became active again
+			continue
+		}
+		if !warned {
+			notify(tc, "this session will be closed in %v (%s)", remaining.Round(time.Second), reason)
+			warned = true
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// SFTP packet types, see
+// https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+const (
+	sshFxpOpen    = 3
+	sshFxpClose   = 4
+	sshFxpRead    = 5
+	sshFxpWrite   = 6
+	sshFxpRemove  = 13
+	sshFxpMkdir   = 14
+	sshFxpRmdir   = 15
+	sshFxpRename  = 18
+	sshFxpSymlink = 20
+	sshFxpHandle  = 102
+	sshFxpData    = 103
+)
+
+// maxAuditedSFTPPacket bounds the memory used for buffering a packet. Larger
+// packets are not inspected.
+const maxAuditedSFTPPacket = 1 << 20
+
+// sftpFile is a file opened via SFTP.
+type sftpFile struct {
+	path    string
+	read    int64
+	written int64
+}
+
+// sftpAuditor wraps the channel of an SFTP session and records which files
+// are transferred (and how many bytes), removed or renamed in the audit log.
+// It observes the packets in both directions without modifying them.
+type sftpAuditor struct {
+	rw  io.ReadWriteCloser
+	log *slog.Logger
+
+	mu          sync.Mutex
+	fromClient  sftpPacketBuffer
+	fromServer  sftpPacketBuffer
+	openPending map[uint32]string // request id → path
+	readPending map[uint32]string // request id → handle
+	files       map[string]*sftpFile
+}
+
+func newSFTPAuditor(rw io.ReadWriteCloser, log *slog.Logger) *sftpAuditor {
+	return &sftpAuditor{
+		rw:          rw,
+		log:         log,
+		openPending: make(map[uint32]string),
+		readPending: make(map[uint32]string),
+		files:       make(map[string]*sftpFile),
+	}
+}
+
+func (a *sftpAuditor) Read(p []byte) (int, error) {
+	n, err := a.rw.Read(p)
+	a.mu.Lock()
+	a.fromClient.feed(p[:n], a.clientPacket)
+	a.mu.Unlock()
+	return n, err
+}
+
+func (a *sftpAuditor) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	a.fromServer.feed(p, a.serverPacket)
+	a.mu.Unlock()
+	return a.rw.Write(p)
+}
+
+func (a *sftpAuditor) Close() error {
+	return a.rw.Close()
+}
+
+// flush records all files which the client did not close.
+func (a *sftpAuditor) flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for handle, f := range a.files {
+		a.logFile(f)
+		delete(a.files, handle)
+	}
+}
+
+func (a *sftpAuditor) logFile(f *sftpFile) {
+	a.log.Info("sftp", "op", "transfer", "path", f.path, "bytes_read", f.read, "bytes_written", f.written)
+}
+
+func (a *sftpAuditor) clientPacket(typ byte, id uint32, r *sftpPacketReader) {
+	switch typ {
+	case sshFxpOpen:
+		a.openPending[id] = r.string()
+	case sshFxpClose:
+		handle := r.string()
+		if f, ok := a.files[handle]; ok {
+			a.logFile(f)
+			delete(a.files, handle)
+		}
+	case sshFxpRead:
+		a.readPending[id] = r.string()
+	case sshFxpWrite:
+		handle := r.string()
+		r.uint64() // offset
+		if f, ok := a.files[handle]; ok {
+			f.written += int64(r.uint32())
+		}
+	case sshFxpRemove:
+		a.log.Info("sftp", "op", "remove", "path", r.string())
+	case sshFxpMkdir:
+		a.log.Info("sftp", "op", "mkdir", "path", r.string())
+	case sshFxpRmdir:
+		a.log.Info("sftp", "op", "rmdir", "path", r.string())
+	case sshFxpRename:
+		a.log.Info("sftp", "op", "rename", "path", r.string(), "new_path", r.string())
+	case sshFxpSymlink:
+		a.log.Info("sftp", "op", "symlink", "path", r.string(), "target", r.string())
+	}
+}
+
+func (a *sftpAuditor) serverPacket(typ byte, id uint32, r *sftpPacketReader) {
+	switch typ {
+	case sshFxpHandle:
+		if path, ok := a.openPending[id]; ok {
+			a.files[r.string()] = &sftpFile{path: path}
+		}
+	case sshFxpData:
+		if handle, ok := a.readPending[id]; ok {
+			if f, ok := a.files[handle]; ok {
+				f.read += int64(r.uint32())
+			}
+		}
+	}
+	// Any response completes the request.
+	delete(a.openPending, id)
+	delete(a.readPending, id)
+}
+
+// sftpPacketBuffer splits a byte stream into SFTP packets.
+type sftpPacketBuffer struct {
+	buf  []byte
+	skip int // bytes of an oversized packet which remain to be skipped
+}
+
+func (b *sftpPacketBuffer) feed(p []byte, packet func(typ byte, id uint32, r *sftpPacketReader)) {
+	if b.skip > 0 {
+		n := min(b.skip, len(p))
+		b.skip -= n
+		p = p[n:]
+	}
+	b.buf = append(b.buf, p...)
+	for len(b.buf) >= 4 {
+		length := int(binary.BigEndian.Uint32(b.buf))
+		if len(b.buf) < 4+length {
+			if length > maxAuditedSFTPPacket {
+				b.skip = 4 + length - len(b.buf)
+				b.buf = nil
+			}
+			return
+		}
+		r := &sftpPacketReader{b: b.buf[4 : 4+length]}
+		typ := r.byte()
+		id := r.uint32()
+		packet(typ, id, r)
+		b.buf = b.buf[4+length:]
+	}
+	if len(b.buf) == 0 {
+		b.buf = nil // release the underlying array
+	}
+}
+
+// sftpPacketReader decodes fields of an SFTP packet, returning zero values
+// for truncated packets.
+type sftpPacketReader struct {
+	b []byte
+}
+
+func (r *sftpPacketReader) next(n int) []byte {
+	if len(r.b) < n {
+		r.b = nil
+		return nil
+	}
+	res := r.b[:n]
+	r.b = r.b[n:]
+	return res
+}
+
+func (r *sftpPacketReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *sftpPacketReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *sftpPacketReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *sftpPacketReader) string() string {
+	n := r.uint32()
+	if uint64(n) > uint64(len(r.b)) {
+		r.b = nil
+		return ""
+	}
+	return string(r.next(int(n)))
+}
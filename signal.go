@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// sshSignals maps the signal names of RFC4254, Section 6.10 to Unix signals.
+var sshSignals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// signalName returns the RFC4254 name of sig. Like OpenSSH, signals which the
+// RFC does not define are reported as e.g. CHLD@openssh.com.
+func signalName(sig syscall.Signal) string {
+	for name, s := range sshSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return strings.TrimPrefix(unix.SignalName(sig), "SIG") + "@openssh.com"
+}
+
+// signalR is a Signal request as per RFC4254 6.9.
+type signalR struct {
+	Signal string
+}
+
+// breakR is a Break request as per RFC4335.
+type breakR struct {
+	BreakLength uint32
+}
+
+// exitSignal is a message for returning the signal which terminated the
+// command as specified in RFC4254, Section 6.10
+type exitSignal struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// signal sends the signal requested by req to the process group of the
+// session's command.
+func (s *session) signal(req *ssh.Request) {
+	var r signalR
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	sig, ok := sshSignals[strings.TrimPrefix(r.Signal, "SIG")]
+	if !ok || s.process == nil {
+		req.Reply(false, nil)
+		return
+	}
+	s.audit.Info("signal", "signal", r.Signal)
+	if err := syscall.Kill(-s.process.Pid, sig); err != nil {
+		log.Printf("signal %s: %v", r.Signal, err)
+		req.Reply(false, nil)
+		return
+	}
+	req.Reply(true, nil)
+}
+
+// foregroundPgrp returns the foreground process group of the PTY ptyf.
+func foregroundPgrp(ptyf *os.File) (int, error) {
+	return unix.IoctlGetInt(int(ptyf.Fd()), unix.TIOCGPGRP)
+}
+
+// sendBreak interrupts the foreground process group of the session's PTY,
+// which is what a BREAK condition on a serial console would do.
+func (s *session) sendBreak(req *ssh.Request) {
+	var r breakR
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil || s.ptyf == nil || s.process == nil {
+		req.Reply(false, nil)
+		return
+	}
+	pgrp, err := foregroundPgrp(s.ptyf)
+	if err != nil {
+		log.Printf("break: %v", err)
+		req.Reply(false, nil)
+		return
+	}
+	s.audit.Info("signal", "signal", "break")
+	if err := syscall.Kill(-pgrp, syscall.SIGINT); err != nil {
+		log.Printf("break: %v", err)
+		req.Reply(false, nil)
+		return
+	}
+	req.Reply(true, nil)
+}
+
+// sendExitStatus reports how the command of the session terminated, either
+// with an exit-status or an exit-signal request.
+func (s *session) sendExitStatus(command string, state *os.ProcessState) {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	var err error
+	if ok && ws.Signaled() {
+		name := signalName(ws.Signal())
+		s.audit.Info("exit", "command", command, "signal", name)
+		_, err = s.channel.SendRequest("exit-signal", false /* wantReply */, ssh.Marshal(exitSignal{
+			Signal:     name,
+			CoreDumped: ws.CoreDump(),
+		}))
+	} else {
+		status := exitStatus{Status: uint32(state.ExitCode())}
+		s.audit.Info("exit", "command", command, "status", status.Status)
+		// See https://tools.ietf.org/html/rfc4254#section-6.10
+		_, err = s.channel.SendRequest("exit-status", false /* wantReply */, ssh.Marshal(status))
+	}
+	if err != nil {
+		log.Printf("sending exit status of %q: %v", command, err)
+	}
+}
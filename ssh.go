@@ -5,28 +5,60 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
-	"github.com/gokrazy/gokrazy"
 	"github.com/google/shlex"
 	"github.com/kr/pty"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
-func handleChannel(newChan ssh.NewChannel) {
+// connection is an authenticated SSH connection.
+type connection struct {
+	sconn *ssh.ServerConn
+	opts  *keyOptions
+	// audit is the audit logger, with attributes identifying the
+	// connection.
+	audit *slog.Logger
+
+	remote remoteForwards
+}
+
+func newConnection(sconn *ssh.ServerConn) *connection {
+	opts := connOptions(sconn.Permissions)
+	audit := auditLog.With(
+		"user", sconn.User(),
+		"remote_addr", sconn.RemoteAddr().String(),
+		"fingerprint", sconn.Permissions.Extensions["fingerprint"])
+	if opts.credential != nil {
+		audit = audit.With("uid", opts.credential.Uid)
+	}
+	return &connection{
+		sconn: sconn,
+		opts:  opts,
+		audit: audit,
+	}
+}
+
+func handleChannel(c *connection, newChan ssh.NewChannel) {
 	switch t := newChan.ChannelType(); t {
 	case "session":
-		handleSession(newChan)
+		handleSession(c, newChan)
 	case "direct-tcpip":
-		handleTCPIP(newChan)
+		handleTCPIP(c, newChan)
+	case "direct-streamlocal@openssh.com":
+		handleStreamLocal(c, newChan)
 	default:
 		newChan.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %q", t))
 		return
@@ -55,33 +87,32 @@ type localForwardChannelData struct {
 	OriginPort uint32
 }
 
-func handleTCPIP(newChan ssh.NewChannel) {
+func handleTCPIP(c *connection, newChan ssh.NewChannel) {
 	d := localForwardChannelData{}
 	if err := ssh.Unmarshal(newChan.ExtraData(), &d); err != nil {
 		newChan.Reject(ssh.ConnectionFailed, "error parsing forward data: "+err.Error())
 		return
 	}
 
-	var ip net.IP
-	switch *forwarding {
-	case "loopback":
-		if ip = parseAddr(d.DestAddr); ip != nil && !ip.IsLoopback() {
-			newChan.Reject(ssh.Prohibited, "port forwarding not allowed for address")
-			return
-		}
-	case "private-network":
-		if ip = parseAddr(d.DestAddr); ip != nil && !gokrazy.IsInPrivateNet(ip) {
-			newChan.Reject(ssh.Prohibited, "port forwarding not allowed for address")
-			return
-		}
-	default:
+	target := net.JoinHostPort(d.DestAddr, strconv.Itoa(int(d.DestPort)))
+	if len(forwardingPolicy) == 0 {
 		newChan.Reject(ssh.Prohibited, "port forwarding is disabled")
 		return
 	}
-
-	// fallthrough for forwarding enabled, validate ip != nil once
+	ip := parseAddr(d.DestAddr)
+	if !c.opts.permitsOpen(d.DestAddr, ip, d.DestPort) {
+		c.audit.Warn("forward denied", "dest", target)
+		newChan.Reject(ssh.Prohibited, "port forwarding not permitted for this key")
+		return
+	}
+	if !forwardingPolicy.allows(d.DestAddr, ip, d.DestPort) {
+		c.audit.Warn("forward denied", "dest", target)
+		newChan.Reject(ssh.Prohibited, "port forwarding not allowed for address")
+		return
+	}
 	if ip == nil {
 		newChan.Reject(ssh.Prohibited, "host not reachable")
+		return
 	}
 
 	dest := net.JoinHostPort(ip.String(), strconv.Itoa(int(d.DestPort)))
@@ -92,6 +123,7 @@ func handleTCPIP(newChan ssh.NewChannel) {
 		newChan.Reject(ssh.ConnectionFailed, err.Error())
 		return
 	}
+	c.audit.Info("forward", "dest", target, "resolved", dest)
 
 	ch, reqs, err := newChan.Accept()
 	if err != nil {
@@ -112,7 +144,7 @@ func handleTCPIP(newChan ssh.NewChannel) {
 	}()
 }
 
-func handleSession(newChannel ssh.NewChannel) {
+func handleSession(c *connection, newChannel ssh.NewChannel) {
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		log.Printf("Could not accept channel (%s)", err)
@@ -123,7 +155,14 @@ func handleSession(newChannel ssh.NewChannel) {
 	go func(channel ssh.Channel, requests <-chan *ssh.Request) {
 		ctx, canc := context.WithCancel(context.Background())
 		defer canc()
-		s := session{channel: channel}
+		tc := newTimedChannel(channel)
+		s := session{channel: tc, sconn: c.sconn, opts: c.opts, audit: c.audit}
+		go s.enforceLimits(ctx, canc, tc)
+		defer func() {
+			if s.agent != nil {
+				s.agent.close()
+			}
+		}()
 		for req := range requests {
 			if err := s.request(ctx, req); err != nil {
 				log.Printf("request(%q): %v", req.Type, err)
@@ -173,6 +212,20 @@ type session struct {
 	ptyf    *os.File
 	ttyf    *os.File
 	channel ssh.Channel
+	sconn   *ssh.ServerConn
+	opts    *keyOptions
+	audit   *slog.Logger
+
+	// terminal type and size, as requested by pty-req and window-change
+	term                      string
+	width, height             uint32
+	widthPixels, heightPixels uint32
+
+	pty *ptySession // non-nil once a command was started on the PTY
+
+	agent *agentForwarder // non-nil if agent forwarding was requested
+
+	process *os.Process // the command started by exec or shell
 }
 
 // ptyreq is a Pseudo-Terminal request as per RFC4254 6.2.
@@ -209,6 +262,67 @@ type subsystem struct {
 	SubsystemName string
 }
 
+// outputWaitDelay is how long to wait for further output once a command
+// exited, see copyOutput.
+const outputWaitDelay = time.Second
+
+// copyOutput copies the output of a command from r to w until EOF and then
+// closes r. Once exited is closed, copying stops when no output could be
+// read for outputWaitDelay: background processes which keep the pipe open
+// (e.g. daemons) should not keep the session open.
+func copyOutput(w io.Writer, r *os.File, exited <-chan struct{}) {
+	defer r.Close()
+	var waiting atomic.Bool
+	go func() {
+		<-exited
+		waiting.Store(true)
+		r.SetReadDeadline(time.Now().Add(outputWaitDelay))
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if waiting.Load() {
+				// Writing might have taken longer than the
+				// deadline, which only applies to reading.
+				r.SetReadDeadline(time.Now().Add(outputWaitDelay))
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// lookPath is like exec.LookPath, but searches the PATH of env (i.e. the
+// directories in which sh -c would look for file) instead of the PATH of
+// breakglass. Relative directories are skipped, as they refer to the working
+// directory.
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	var path string
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			path = v // like exec.Cmd, use the last value
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		p := filepath.Join(dir, file)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
 // exitStatus is a message for returning exit status as specified in RFC4254, Section 6.10
 type exitStatus struct {
 	Status uint32
@@ -238,6 +352,13 @@ func findShell() string {
 func (s *session) request(ctx context.Context, req *ssh.Request) error {
 	switch req.Type {
 	case "pty-req":
+		if s.opts.noPTY {
+			// Like OpenSSH, refuse without failing the session, so that
+			// the command runs without a PTY.
+			log.Printf("PTY allocation not permitted for this key")
+			req.Reply(false, nil)
+			return nil
+		}
 		var r ptyreq
 		if err := ssh.Unmarshal(req.Payload, &r); err != nil {
 			return err
@@ -251,8 +372,19 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 		if err != nil {
 			return err
 		}
+		if cred := s.opts.credential; cred != nil {
+			if err := s.ttyf.Chown(int(cred.Uid), int(cred.Gid)); err != nil {
+				return err
+			}
+		}
+
+		if err := setTermModes(int(s.ttyf.Fd()), []byte(r.Modes)); err != nil {
+			log.Printf("setting terminal modes: %v", err)
+		}
 
-		SetWinsize(s.ptyf.Fd(), r.WidthCharacters, r.HeightRows)
+		s.term, s.width, s.height = r.TERM, r.WidthCharacters, r.HeightRows
+		s.widthPixels, s.heightPixels = r.WidthPixels, r.HeightPixels
+		SetWinsize(s.ptyf.Fd(), r.WidthCharacters, r.HeightRows, r.WidthPixels, r.HeightPixels)
 		// Responding true (OK) here will let the client
 		// know we have a pty ready for input
 		req.Reply(true, nil)
@@ -263,7 +395,27 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 			return err
 		}
 
-		SetWinsize(s.ptyf.Fd(), r.WidthColumns, r.HeightRows)
+		s.width, s.height = r.WidthColumns, r.HeightRows
+		s.widthPixels, s.heightPixels = r.WidthPixels, r.HeightPixels
+		if s.pty != nil {
+			s.pty.resize(s, r.WidthColumns, r.HeightRows, r.WidthPixels, r.HeightPixels)
+		} else if s.ptyf != nil {
+			SetWinsize(s.ptyf.Fd(), r.WidthColumns, r.HeightRows, r.WidthPixels, r.HeightPixels)
+		}
+
+	case "auth-agent-req@openssh.com":
+		if s.opts.noAgentForwarding || s.agent != nil {
+			// Like OpenSSH, refuse without failing the session.
+			req.Reply(false, nil)
+			return nil
+		}
+		agent, err := s.startAgentForwarding()
+		if err != nil {
+			return err
+		}
+		s.agent = agent
+		s.audit.Info("agent forwarding", "socket", agent.path)
+		req.Reply(true, nil)
 
 	case "env":
 		var r env
@@ -271,7 +423,15 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 			return err
 		}
 
+		if !acceptEnv(r.VariableName) {
+			// Like OpenSSH, ignore the variable without failing the
+			// session.
+			log.Printf("ignoring environment variable %q (see -accept_env)", r.VariableName)
+			req.Reply(false, nil)
+			return nil
+		}
 		s.env = append(s.env, fmt.Sprintf("%s=%s", r.VariableName, r.VariableValue))
+		req.Reply(true, nil)
 
 	case "subsystem":
 		var sr subsystem
@@ -281,15 +441,27 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 
 		log.Printf("client requests subsystem %q", sr.SubsystemName)
 
+		if s.opts.command != "" {
+			return fmt.Errorf("subsystem %q not permitted: key is restricted to a command", sr.SubsystemName)
+		}
+
 		if sr.SubsystemName != "sftp" {
 			return fmt.Errorf("subsystem %q not yet implemented", sr.SubsystemName)
 		}
 
+		if s.opts.credential != nil {
+			// The SFTP server runs within breakglass, i.e. as root.
+			return fmt.Errorf("subsystem %q not permitted for unprivileged users", sr.SubsystemName)
+		}
+
 		log.Printf("starting SFTP subsystem")
+		s.audit.Info("subsystem", "name", sr.SubsystemName)
 
 		req.Reply(true, nil)
 
-		srv, err := sftp.NewServer(s.channel, sftp.WithDebug(os.Stderr))
+		auditor := newSFTPAuditor(s.channel, s.audit)
+		defer auditor.flush()
+		srv, err := sftp.NewServer(auditor, sftp.WithDebug(os.Stderr))
 		if err != nil {
 			return err
 		}
@@ -347,77 +519,150 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 			return err
 		}
 
+		if s.opts.command != "" {
+			if req.Type == "exec" {
+				s.env = append(s.env, "SSH_ORIGINAL_COMMAND="+r.Command)
+			}
+			r.Command = s.opts.command
+		}
+
 		cmdline, err := shlex.Split(r.Command)
 		if err != nil {
 			return err
 		}
+		if len(cmdline) == 0 {
+			return fmt.Errorf("empty command")
+		}
 
 		if cmdline[0] == "scp" {
-			return scpSink(s.channel, req, cmdline)
+			if s.opts.credential != nil {
+				// scpSink runs within breakglass, i.e. as root.
+				return fmt.Errorf("scp not permitted for unprivileged users")
+			}
+			return scpSink(s.channel, req, cmdline, s.audit)
 		}
 
-		// Ensure the $HOME directory exists so that shell history works without
-		// any extra steps.
-		if err := os.MkdirAll("/perm/home", 0755); err != nil {
-			// TODO: Suppress -EROFS
-			log.Print(err)
+		if cmdline[0] == "breakglass" {
+			return s.runBuiltin(req, cmdline)
+		}
+
+		home := homeDir(s.opts.credential)
+
+		if s.ttyf != nil && *persistentSessionTimeout > 0 {
+			// Persistent sessions outlive the channel.
+			ctx = context.Background()
+		}
+		env := expandPath(s.env)
+		env = append(env,
+			"HOME="+home,
+			"TMPDIR=/tmp")
+		// Variables from -env_file take precedence (exec.Cmd uses the
+		// last value of duplicate variables).
+		env = append(env, serverEnv...)
+		if s.agent != nil {
+			env = append(env, "SSH_AUTH_SOCK="+s.agent.path)
 		}
 
+		// Interactive shells are started even in strict mode, which only
+		// concerns the interpretation of commands.
+		interactive := req.Type == "shell" && s.opts.command == ""
+		strict := (*strictExec || s.opts.strictExec) && !interactive
+		// findShell also installs busybox, whose utilities strict mode
+		// looks up in $PATH.
+		shell := findShell()
 		var cmd *exec.Cmd
-		if shell := findShell(); shell != "" {
+		if strict {
+			path, err := lookPath(cmdline[0], env)
+			if err != nil {
+				return err
+			}
+			cmd = exec.CommandContext(ctx, path, cmdline[1:]...)
+			cmd.Args[0] = cmdline[0]
+		} else if shell != "" {
 			cmd = exec.CommandContext(ctx, shell, "-c", r.Command)
+		} else if self, err := os.Executable(); err == nil {
+			// Fall back to the built-in shell (see goshell.go).
+			cmd = exec.CommandContext(ctx, self)
+			cmd.Args = []string{"sh", "-c", r.Command}
+			if interactive {
+				cmd.Args = []string{"sh"}
+			}
 		} else {
 			cmd = exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
 		}
 		log.Printf("Starting cmd %q", cmd.Args)
-		env := expandPath(s.env)
-		env = append(env,
-			"HOME=/perm/home",
-			"TMPDIR=/tmp")
+		s.audit.Info("exec", "command", r.Command, "args", cmd.Args, "pty", s.ttyf != nil, "strict", strict)
 		cmd.Env = env
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: s.opts.credential,
+		}
+		// Commands run in their own session (Setsid), so kill the entire
+		// process group when ctx is cancelled.
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
 
 		if s.ttyf == nil {
-			stdout, err := cmd.StdoutPipe()
+			// The output is copied from pipes instead of using
+			// cmd.StdoutPipe, whose reads race with cmd.Wait closing
+			// the pipe, which truncated the output.
+			stdoutr, stdoutw, err := os.Pipe()
 			if err != nil {
 				return err
 			}
-			stdin, err := cmd.StdinPipe()
+			stderrr, stderrw, err := os.Pipe()
 			if err != nil {
+				stdoutr.Close()
+				stdoutw.Close()
 				return err
 			}
-			stderr, err := cmd.StderrPipe()
+			cmd.Stdout = stdoutw
+			cmd.Stderr = stderrw
+			stdin, err := cmd.StdinPipe()
 			if err != nil {
 				return err
 			}
 			cmd.SysProcAttr.Setsid = true
 
-			if err := cmd.Start(); err != nil {
+			err = cmd.Start()
+			// The write ends are only used by the command.
+			stdoutw.Close()
+			stderrw.Close()
+			if err != nil {
+				stdoutr.Close()
+				stderrr.Close()
 				return err
 			}
 
 			req.Reply(true, nil)
 
-			go io.Copy(s.channel, stdout)
-			go io.Copy(s.channel.Stderr(), stderr)
+			exited := make(chan struct{})
+			var output sync.WaitGroup
+			output.Add(2)
+			go func() {
+				defer output.Done()
+				copyOutput(s.channel, stdoutr, exited)
+			}()
+			go func() {
+				defer output.Done()
+				copyOutput(s.channel.Stderr(), stderrr, exited)
+			}()
 			go func() {
 				io.Copy(stdin, s.channel)
 				stdin.Close()
 			}()
 
+			s.process = cmd.Process
+			untrack := trackExecCommand(cmd.Process.Pid)
+
 			go func() {
 				if err := cmd.Wait(); err != nil {
 					log.Printf("err: %v", err)
 				}
-				var status exitStatus
-				if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
-					status.Status = uint32(ws.ExitStatus())
-				}
-
-				// See https://tools.ietf.org/html/rfc4254#section-6.10
-				if _, err := s.channel.SendRequest("exit-status", false /* wantReply */, ssh.Marshal(status)); err != nil {
-					log.Printf("err2: %v", err)
-				}
+				untrack()
+				close(exited)
+				output.Wait()
+				s.sendExitStatus(r.Command, cmd.ProcessState)
 				s.channel.Close()
 			}()
 			return nil
@@ -440,23 +685,14 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 			return err
 		}
 
-		close := func() {
-			s.channel.Close()
-			cmd.Process.Wait()
-		}
+		req.Reply(true, nil)
+		newPTYSession(s, cmd, r.Command)
 
-		// pipe session to cmd and vice-versa
-		var once sync.Once
-		go func() {
-			io.Copy(s.channel, s.ptyf)
-			once.Do(close)
-		}()
-		go func() {
-			io.Copy(s.ptyf, s.channel)
-			once.Do(close)
-		}()
+	case "signal":
+		s.signal(req)
 
-		req.Reply(true, nil)
+	case "break":
+		s.sendBreak(req)
 
 	default:
 		return fmt.Errorf("unknown request type: %q", req.Type)
@@ -465,16 +701,17 @@ func (s *session) request(ctx context.Context, req *ssh.Request) error {
 	return nil
 }
 
-// Winsize stores the Height and Width of a terminal.
+// Winsize stores the Height and Width of a terminal, in characters and
+// pixels.
 type Winsize struct {
 	Height uint16
 	Width  uint16
-	x      uint16 // unused
-	y      uint16 // unused
+	XPixel uint16
+	YPixel uint16
 }
 
 // SetWinsize sets the size of the given pty.
-func SetWinsize(fd uintptr, w, h uint32) {
-	ws := &Winsize{Width: uint16(w), Height: uint16(h)}
+func SetWinsize(fd uintptr, w, h, wpx, hpx uint32) {
+	ws := &Winsize{Width: uint16(w), Height: uint16(h), XPixel: uint16(wpx), YPixel: uint16(hpx)}
 	syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCSWINSZ), uintptr(unsafe.Pointer(ws)))
 }
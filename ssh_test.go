@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowWriter is an io.Writer for a slow connection.
+type slowWriter struct {
+	delay time.Duration
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// runCopyOutput runs the shell script with copyOutput and returns its
+// output and how long copying took after the script exited.
+func runCopyOutput(t *testing.T, script string, delay time.Duration) (string, time.Duration) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		t.Skip(err)
+	}
+	exited := make(chan struct{})
+	done := make(chan struct{})
+	out := &slowWriter{delay: delay}
+	go func() {
+		defer close(done)
+		copyOutput(out, r, exited)
+	}()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	close(exited)
+	<-done
+	return out.buf.String(), time.Since(start)
+}
+
+func TestCopyOutput(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		lines int
+		delay time.Duration
+	}{
+		{"fast", 100000, 0},
+		// Sending the output which is still buffered in the pipe when
+		// the command exits takes longer than outputWaitDelay.
+		{"slow", 20000, outputWaitDelay / 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _ := runCopyOutput(t, "seq 1 "+strconv.Itoa(tt.lines), tt.delay)
+			if got := strings.Count(out, "\n"); got != tt.lines {
+				t.Errorf("copied %d lines, want %d", got, tt.lines)
+			}
+		})
+	}
+}
+
+func TestCopyOutputBackground(t *testing.T) {
+	// The background process keeps the pipe open without writing.
+	out, took := runCopyOutput(t, "echo started; sleep 10 &", 0)
+	if out != "started\n" {
+		t.Errorf("output = %q, want %q", out, "started\n")
+	}
+	if took > outputWaitDelay+2*time.Second {
+		t.Errorf("copying took %v after the command exited, want about %v", took, outputWaitDelay)
+	}
+}
+
+func TestLookPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"tool", 0755},
+		{"bin/tool", 0755},
+		{"bin/data", 0644},
+		{"other/tool", 0755},
+		{"other/data", 0755},
+	} {
+		path := filepath.Join(dir, f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bin, other := filepath.Join(dir, "bin"), filepath.Join(dir, "other")
+	t.Chdir(dir)
+	for _, tt := range []struct {
+		file string
+		path string
+		want string // empty if not found
+	}{
+		{"tool", bin + ":" + other, bin + "/tool"},
+		{"tool", other + ":" + bin, other + "/tool"},
+		{"data", bin + ":" + other, other + "/data"}, // not executable in bin
+		{"bin", dir, ""}, // directory
+		{"tool", "bin:" + other, other + "/tool"}, // relative directory
+		{"tool", ":" + other, other + "/tool"},    // working directory
+		{"tool", "", ""},
+		{"./bin/tool", "", "./bin/tool"},
+		{"missing", bin, ""},
+	} {
+		got, err := lookPath(tt.file, []string{"PATH=/nonexistent", "PATH=" + tt.path})
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("lookPath(%q) in %q = %q, want error", tt.file, tt.path, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("lookPath(%q) in %q = %q, %v, want %q", tt.file, tt.path, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// direct-streamlocal@openssh.com data struct as specified in OpenSSH's
+// PROTOCOL, Section 2.4
+type streamLocalChannelData struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// streamlocal-forward@openssh.com and cancel-streamlocal-forward@openssh.com
+// request payload
+type streamLocalForwardRequest struct {
+	SocketPath string
+}
+
+// forwarded-streamlocal@openssh.com data struct
+type forwardedStreamLocalChannelData struct {
+	SocketPath string
+	Reserved   string
+}
+
+// permitsSocket returns an error unless path matches -forward_unix_sockets
+// and unix socket forwarding is permitted for the connection.
+func (c *connection) permitsSocket(path string) error {
+	if c.opts.noPortForwarding {
+		return fmt.Errorf("port forwarding not permitted for this key")
+	}
+	if c.opts.credential != nil {
+		return fmt.Errorf("unix socket forwarding is not available to unprivileged users")
+	}
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("socket path must be absolute and clean")
+	}
+	for _, pattern := range strings.Split(*forwardUnixSockets, ",") {
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("unix socket forwarding not allowed for path")
+}
+
+func handleStreamLocal(c *connection, newChan ssh.NewChannel) {
+	var d streamLocalChannelData
+	if err := ssh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+	if err := c.permitsSocket(d.SocketPath); err != nil {
+		c.audit.Warn("forward denied", "socket", d.SocketPath, "reason", err.Error())
+		newChan.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	dconn, err := net.Dial("unix", d.SocketPath)
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	c.audit.Info("forward", "socket", d.SocketPath)
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		defer ch.Close()
+		defer dconn.Close()
+		io.Copy(ch, dconn)
+	}()
+	go func() {
+		defer ch.Close()
+		defer dconn.Close()
+		io.Copy(dconn, ch)
+	}()
+}
+
+func (c *connection) handleStreamLocalForward(req *ssh.Request) {
+	var r streamLocalForwardRequest
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	if err := c.permitsSocket(r.SocketPath); err != nil {
+		c.audit.Warn("remote forward denied", "socket", r.SocketPath, "reason", err.Error())
+		req.Reply(false, nil)
+		return
+	}
+	ln, err := net.Listen("unix", r.SocketPath)
+	if err != nil {
+		c.audit.Warn("remote forward denied", "socket", r.SocketPath, "reason", err.Error())
+		req.Reply(false, nil)
+		return
+	}
+	c.remote.mu.Lock()
+	if c.remote.listeners == nil {
+		c.remote.listeners = make(map[string]net.Listener)
+	}
+	if old, ok := c.remote.listeners[r.SocketPath]; ok {
+		old.Close()
+	}
+	c.remote.listeners[r.SocketPath] = ln
+	c.remote.mu.Unlock()
+	req.Reply(true, nil)
+	c.audit.Info("remote forward", "socket", r.SocketPath)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // listener closed
+			}
+			go c.forwardStreamLocalConn(conn, r.SocketPath)
+		}
+	}()
+}
+
+// forwardStreamLocalConn forwards conn, which was accepted on the listener
+// for path, to the client in a forwarded-streamlocal@openssh.com channel.
+func (c *connection) forwardStreamLocalConn(conn net.Conn, path string) {
+	defer conn.Close()
+	payload := ssh.Marshal(forwardedStreamLocalChannelData{SocketPath: path})
+	ch, reqs, err := c.sconn.OpenChannel("forwarded-streamlocal@openssh.com", payload)
+	if err != nil {
+		log.Printf("forwarded-streamlocal: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer ch.Close()
+	go func() {
+		defer ch.CloseWrite()
+		io.Copy(ch, conn)
+	}()
+	io.Copy(conn, ch)
+}
+
+func (c *connection) handleCancelStreamLocalForward(req *ssh.Request) {
+	var r streamLocalForwardRequest
+	if err := ssh.Unmarshal(req.Payload, &r); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	c.remote.mu.Lock()
+	ln, ok := c.remote.listeners[r.SocketPath]
+	delete(c.remote.listeners, r.SocketPath)
+	c.remote.mu.Unlock()
+	if !ok {
+		req.Reply(false, nil)
+		return
+	}
+	ln.Close()
+	c.audit.Info("remote forward cancelled", "socket", r.SocketPath)
+	req.Reply(true, nil)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opcodes of the encoded terminal modes, see RFC4254, Section 8.
+const (
+	ttyOpEnd    = 0
+	ttyOpISpeed = 128
+	ttyOpOSpeed = 129
+)
+
+// termChars maps terminal mode opcodes to special characters (indices into
+// Termios.Cc). Opcodes without a Linux equivalent (VDSUSP, VFLUSH,
+// VSTATUS) are ignored.
+var termChars = map[byte]int{
+	1:  unix.VINTR,
+	2:  unix.VQUIT,
+	3:  unix.VERASE,
+	4:  unix.VKILL,
+	5:  unix.VEOF,
+	6:  unix.VEOL,
+	7:  unix.VEOL2,
+	8:  unix.VSTART,
+	9:  unix.VSTOP,
+	10: unix.VSUSP,
+	12: unix.VREPRINT,
+	13: unix.VWERASE,
+	14: unix.VLNEXT,
+	16: unix.VSWTC,
+	18: unix.VDISCARD,
+}
+
+// termFlag is a flag in one of the Termios flag fields.
+type termFlag struct {
+	field func(*unix.Termios) *uint32
+	flag  uint32
+}
+
+func iflag(t *unix.Termios) *uint32 { return &t.Iflag }
+func oflag(t *unix.Termios) *uint32 { return &t.Oflag }
+func cflag(t *unix.Termios) *uint32 { return &t.Cflag }
+func lflag(t *unix.Termios) *uint32 { return &t.Lflag }
+
+// termFlags maps terminal mode opcodes to termios flags.
+var termFlags = map[byte]termFlag{
+	30: {iflag, unix.IGNPAR},
+	31: {iflag, unix.PARMRK},
+	32: {iflag, unix.INPCK},
+	33: {iflag, unix.ISTRIP},
+	34: {iflag, unix.INLCR},
+	35: {iflag, unix.IGNCR},
+	36: {iflag, unix.ICRNL},
+	37: {iflag, unix.IUCLC},
+	38: {iflag, unix.IXON},
+	39: {iflag, unix.IXANY},
+	40: {iflag, unix.IXOFF},
+	41: {iflag, unix.IMAXBEL},
+	42: {iflag, unix.IUTF8}, // RFC8160
+
+	50: {lflag, unix.ISIG},
+	51: {lflag, unix.ICANON},
+	52: {lflag, unix.XCASE},
+	53: {lflag, unix.ECHO},
+	54: {lflag, unix.ECHOE},
+	55: {lflag, unix.ECHOK},
+	56: {lflag, unix.ECHONL},
+	57: {lflag, unix.NOFLSH},
+	58: {lflag, unix.TOSTOP},
+	59: {lflag, unix.IEXTEN},
+	60: {lflag, unix.ECHOCTL},
+	61: {lflag, unix.ECHOKE},
+	62: {lflag, unix.PENDIN},
+
+	70: {oflag, unix.OPOST},
+	71: {oflag, unix.OLCUC},
+	72: {oflag, unix.ONLCR},
+	73: {oflag, unix.OCRNL},
+	74: {oflag, unix.ONOCR},
+	75: {oflag, unix.ONLRET},
+
+	92: {cflag, unix.PARENB},
+	93: {cflag, unix.PARODD},
+}
+
+// termSpeeds maps baud rates to their termios constants.
+var termSpeeds = map[uint32]uint32{
+	50:      unix.B50,
+	75:      unix.B75,
+	110:     unix.B110,
+	134:     unix.B134,
+	150:     unix.B150,
+	200:     unix.B200,
+	300:     unix.B300,
+	600:     unix.B600,
+	1200:    unix.B1200,
+	1800:    unix.B1800,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+}
+
+// applyTermModes modifies t according to the encoded terminal modes of a
+// pty-req (RFC4254, Section 8). Unknown opcodes are ignored.
+func applyTermModes(t *unix.Termios, modes []byte) error {
+	for len(modes) > 0 {
+		op := modes[0]
+		if op == ttyOpEnd {
+			return nil
+		}
+		if op >= 160 {
+			// Opcodes 160 to 255 are not yet defined and cause
+			// parsing to stop.
+			return nil
+		}
+		if len(modes) < 5 {
+			return fmt.Errorf("truncated terminal mode %d", op)
+		}
+		val := binary.BigEndian.Uint32(modes[1:5])
+		modes = modes[5:]
+
+		if idx, ok := termChars[op]; ok {
+			if val == 255 {
+				val = 0 // _POSIX_VDISABLE
+			}
+			t.Cc[idx] = uint8(val)
+			continue
+		}
+		if f, ok := termFlags[op]; ok {
+			if val != 0 {
+				*f.field(t) |= f.flag
+			} else {
+				*f.field(t) &^= f.flag
+			}
+			continue
+		}
+		switch op {
+		case 90, 91: // CS7, CS8
+			size := uint32(unix.CS7)
+			if op == 91 {
+				size = unix.CS8
+			}
+			if val != 0 {
+				t.Cflag = t.Cflag&^unix.CSIZE | size
+			}
+		case ttyOpISpeed:
+			// TCSETS only considers the speed bits of Cflag.
+			if speed, ok := termSpeeds[val]; ok {
+				t.Cflag = t.Cflag&^unix.CIBAUD | speed<<unix.IBSHIFT
+			}
+		case ttyOpOSpeed:
+			if speed, ok := termSpeeds[val]; ok {
+				t.Cflag = t.Cflag&^unix.CBAUD | speed
+			}
+		}
+	}
+	return nil
+}
+
+// setTermModes applies the encoded terminal modes to the terminal fd.
+func setTermModes(fd int, modes []byte) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	if err := applyTermModes(t, modes); err != nil {
+		return err
+	}
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
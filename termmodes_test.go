@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/kr/pty"
+	"golang.org/x/sys/unix"
+)
+
+// encodeTermModes encodes opcode/value pairs as in a pty-req, followed by
+// TTY_OP_END.
+func encodeTermModes(pairs ...uint32) []byte {
+	var b []byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		b = append(b, byte(pairs[i]))
+		b = binary.BigEndian.AppendUint32(b, pairs[i+1])
+	}
+	return append(b, ttyOpEnd)
+}
+
+func TestApplyTermModes(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		modes []byte
+		in    unix.Termios
+		check func(*unix.Termios) bool
+	}{
+		{
+			name:  "empty",
+			modes: nil,
+			in:    unix.Termios{Lflag: unix.ECHO},
+			check: func(t *unix.Termios) bool { return t.Lflag == unix.ECHO },
+		},
+		{
+			name:  "VINTR",
+			modes: encodeTermModes(1, 3),
+			check: func(t *unix.Termios) bool { return t.Cc[unix.VINTR] == 3 },
+		},
+		{
+			name:  "VERASE disabled",
+			modes: encodeTermModes(3, 255),
+			in: func() (t unix.Termios) {
+				t.Cc[unix.VERASE] = 127
+				return t
+			}(),
+			check: func(t *unix.Termios) bool { return t.Cc[unix.VERASE] == 0 },
+		},
+		{
+			name:  "set and clear flags",
+			modes: encodeTermModes(53, 0, 36, 1, 72, 1, 42, 1),
+			in:    unix.Termios{Lflag: unix.ECHO | unix.ICANON},
+			check: func(t *unix.Termios) bool {
+				return t.Lflag == unix.ICANON &&
+					t.Iflag == unix.ICRNL|unix.IUTF8 &&
+					t.Oflag == unix.ONLCR
+			},
+		},
+		{
+			name:  "CS8",
+			modes: encodeTermModes(91, 1),
+			in:    unix.Termios{Cflag: unix.CS7 | unix.PARENB},
+			check: func(t *unix.Termios) bool { return t.Cflag == unix.CS8|unix.PARENB },
+		},
+		{
+			name:  "speeds",
+			modes: encodeTermModes(ttyOpISpeed, 38400, ttyOpOSpeed, 38400),
+			check: func(t *unix.Termios) bool {
+				return t.Cflag&unix.CBAUD == unix.B38400 &&
+					t.Cflag&unix.CIBAUD == unix.B38400<<unix.IBSHIFT
+			},
+		},
+		{
+			name:  "unknown speed",
+			modes: encodeTermModes(ttyOpOSpeed, 12345),
+			in:    unix.Termios{Cflag: unix.B9600},
+			check: func(t *unix.Termios) bool { return t.Cflag == unix.B9600 },
+		},
+		{
+			name:  "unknown opcode",
+			modes: encodeTermModes(11, 1, 53, 1),
+			check: func(t *unix.Termios) bool { return t.Lflag == unix.ECHO },
+		},
+		{
+			name:  "undefined opcode stops parsing",
+			modes: append([]byte{160}, encodeTermModes(53, 1)...),
+			check: func(t *unix.Termios) bool { return t.Lflag == 0 },
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			termios := tt.in
+			if err := applyTermModes(&termios, tt.modes); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(&termios) {
+				t.Errorf("applyTermModes(%x) = %+v, unexpected result", tt.modes, termios)
+			}
+		})
+	}
+}
+
+func TestApplyTermModesTruncated(t *testing.T) {
+	var termios unix.Termios
+	if err := applyTermModes(&termios, []byte{53, 0, 0}); err == nil {
+		t.Errorf("applyTermModes unexpectedly succeeded")
+	}
+}
+
+func TestSetTermModes(t *testing.T) {
+	ptyf, ttyf, err := pty.Open()
+	if err != nil {
+		t.Skipf("pty.Open: %v", err)
+	}
+	defer ptyf.Close()
+	defer ttyf.Close()
+	fd := int(ttyf.Fd())
+	if err := setTermModes(fd, encodeTermModes(53, 0, 1, 7)); err != nil {
+		t.Fatal(err)
+	}
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&unix.ECHO != 0 {
+		t.Errorf("ECHO still set")
+	}
+	if got := termios.Cc[unix.VINTR]; got != 7 {
+		t.Errorf("VINTR = %d, want 7", got)
+	}
+}
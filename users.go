@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// userMap maps SSH user names and key fingerprints to the Unix credentials
+// with which the commands of a session are run.
+type userMap map[string]*syscall.Credential
+
+// loadUserMap reads a file with one mapping per line:
+//
+//	# <user name or SHA256 key fingerprint> <uid>:<gid>[:<groups>]
+//	observer              65534:65534
+//	SHA256:uGZ2…          1000:1000:27,44
+//	*                     0:0
+//
+// Users without a mapping (and without a * entry) run commands as root.
+func loadUserMap(path string) (userMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := make(userMap)
+	s := bufio.NewScanner(f)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <user> <uid>:<gid>[:<groups>]", path, lineNum)
+		}
+		cred, err := parseCredential(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		result[fields[0]] = cred
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func parseCredential(spec string) (*syscall.Credential, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid credential %q: expected <uid>:<gid>[:<groups>]", spec)
+	}
+	parseID := func(s string) (uint32, error) {
+		id, err := strconv.ParseUint(s, 10, 32)
+		return uint32(id), err
+	}
+	uid, err := parseID(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	gid, err := parseID(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	cred := &syscall.Credential{Uid: uid, Gid: gid}
+	if len(parts) == 3 && parts[2] != "" {
+		for _, g := range strings.Split(parts[2], ",") {
+			id, err := parseID(g)
+			if err != nil {
+				return nil, err
+			}
+			cred.Groups = append(cred.Groups, id)
+		}
+	}
+	return cred, nil
+}
+
+// lookup returns the credential for a login, or nil if commands should run
+// as root (i.e. with the credentials of breakglass itself). A mapping for the
+// key takes precedence over a mapping for the user name.
+func (m userMap) lookup(user string, pubKey ssh.PublicKey) *syscall.Credential {
+	if cert, ok := pubKey.(*ssh.Certificate); ok {
+		pubKey = cert.Key
+	}
+	for _, name := range []string{ssh.FingerprintSHA256(pubKey), user, "*"} {
+		if cred, ok := m[name]; ok {
+			if cred.Uid == 0 && cred.Gid == 0 && len(cred.Groups) == 0 {
+				return nil
+			}
+			return cred
+		}
+	}
+	return nil
+}
+
+// homeDir returns the $HOME directory for commands run with cred (nil meaning
+// root) and ensures that it exists, so that shell history works without any
+// extra steps.
+func homeDir(cred *syscall.Credential) string {
+	home := "/perm/home"
+	if cred != nil {
+		home = fmt.Sprintf("/perm/home/%d", cred.Uid)
+	}
+	if err := os.MkdirAll(home, 0755); err != nil {
+		// TODO: Suppress -EROFS
+		log.Print(err)
+		return home
+	}
+	if cred != nil {
+		if err := os.Chown(home, int(cred.Uid), int(cred.Gid)); err != nil {
+			log.Print(err)
+		}
+	}
+	return home
+}